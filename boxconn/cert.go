@@ -0,0 +1,266 @@
+package boxconn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certificateVersion is the version of the certificate encoding
+const certificateVersion = 1
+
+// certificateContext is prepended to the certificate before it is signed,
+// so the signature can't be mistaken for one over something else
+const certificateContext = "boxconn certificate\x00"
+
+type (
+	// A Certificate vouches for a peer's public key. It is signed by an
+	// authority, usually kept offline, whose Ed25519 public key is listed in
+	// Config.CertificateAuthorities of the other side. That way servers
+	// only need to know the authority instead of every client's key.
+	Certificate struct {
+		// Key is the public key the certificate is for
+		Key [keySize]byte
+		// Name identifies the holder, it becomes the peer's name
+		Name string
+		// NotBefore and NotAfter limit when the certificate is valid. The
+		// zero value means no limit.
+		NotBefore, NotAfter time.Time
+		// Hosts, if not empty, lists the only hosts the certificate may be
+		// used with. A client's certificate is checked against the server's
+		// Config.HostName, a server's against the host the client dialed.
+		Hosts []string
+		// Signature is the authority's signature, set by Sign
+		Signature []byte
+	}
+
+	// RevocationList is a list of revoked keys backed by a file. The file is
+	// reloaded whenever it changes. Each line has a base64 encoded public
+	// key and optionally a comment:
+	//
+	//     # comments start with a #
+	//     8VBo1sPMIoR8VxB2oKgDs4v7tTFXGSpJ1xdn7DdOGR4= alice's stolen laptop
+	RevocationList struct {
+		mu   sync.Mutex
+		file watchedFile
+		keys map[[keySize]byte]bool
+	}
+)
+
+// Sign signs the certificate with the authority's private key
+func (c *Certificate) Sign(authority ed25519.PrivateKey) {
+	c.Signature = ed25519.Sign(authority, c.signedData())
+}
+
+// Marshal encodes the certificate, including its signature
+func (c *Certificate) Marshal() []byte {
+	var buf bytes.Buffer
+	c.writeTo(&buf)
+	buf.Write(c.Signature)
+	return buf.Bytes()
+}
+
+// signedData is what the authority signs: everything but the signature
+func (c *Certificate) signedData() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(certificateContext)
+	c.writeTo(&buf)
+	return buf.Bytes()
+}
+
+func (c *Certificate) writeTo(buf *bytes.Buffer) {
+	buf.WriteByte(certificateVersion)
+	buf.Write(c.Key[:])
+	writeString(buf, c.Name)
+	binary.Write(buf, binary.BigEndian, unixTime(c.NotBefore))
+	binary.Write(buf, binary.BigEndian, unixTime(c.NotAfter))
+	binary.Write(buf, binary.BigEndian, uint16(len(c.Hosts)))
+	for _, host := range c.Hosts {
+		writeString(buf, host)
+	}
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnixTime(secs int64) time.Time {
+	if secs == 0 {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0).UTC()
+}
+
+// ParseCertificate decodes a certificate encoded with Marshal. It doesn't
+// check the signature, use Verify for that.
+func ParseCertificate(data []byte) (*Certificate, error) {
+	r := bytes.NewReader(data)
+	c := &Certificate{}
+
+	version, err := r.ReadByte()
+	if err != nil || version != certificateVersion {
+		return nil, ErrInvalidCertificate
+	}
+	if _, err := io.ReadFull(r, c.Key[:]); err != nil {
+		return nil, ErrInvalidCertificate
+	}
+	if c.Name, err = readString(r); err != nil {
+		return nil, ErrInvalidCertificate
+	}
+	var notBefore, notAfter int64
+	var hosts uint16
+	if binary.Read(r, binary.BigEndian, &notBefore) != nil ||
+		binary.Read(r, binary.BigEndian, &notAfter) != nil ||
+		binary.Read(r, binary.BigEndian, &hosts) != nil {
+		return nil, ErrInvalidCertificate
+	}
+	c.NotBefore, c.NotAfter = fromUnixTime(notBefore), fromUnixTime(notAfter)
+	for i := 0; i < int(hosts); i++ {
+		host, err := readString(r)
+		if err != nil {
+			return nil, ErrInvalidCertificate
+		}
+		c.Hosts = append(c.Hosts, host)
+	}
+
+	if r.Len() != ed25519.SignatureSize {
+		return nil, ErrInvalidCertificate
+	}
+	c.Signature = make([]byte, ed25519.SignatureSize)
+	r.Read(c.Signature)
+	return c, nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	if int(length) > r.Len() {
+		return "", io.ErrUnexpectedEOF
+	}
+	bs := make([]byte, length)
+	r.Read(bs)
+	return string(bs), nil
+}
+
+// Verify checks that the certificate is signed by one of the authorities,
+// is valid at now and may be used with host. An empty host skips the host
+// check.
+func (c *Certificate) Verify(authorities []ed25519.PublicKey, host string, now time.Time) error {
+	signed := c.signedData()
+	trusted := false
+	for _, authority := range authorities {
+		if len(authority) == ed25519.PublicKeySize && ed25519.Verify(authority, signed, c.Signature) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return ErrInvalidCertificate
+	}
+
+	if (!c.NotBefore.IsZero() && now.Before(c.NotBefore)) || (!c.NotAfter.IsZero() && now.After(c.NotAfter)) {
+		return ErrCertificateExpired
+	}
+
+	if host != "" && len(c.Hosts) > 0 {
+		for _, h := range c.Hosts {
+			if strings.EqualFold(h, host) {
+				return nil
+			}
+		}
+		return ErrCertificateHost
+	}
+	return nil
+}
+
+// verifyCertificate checks the certificate the peer sent in its hello, host
+// is what its Hosts have to include
+func verifyCertificate(config *Config, data []byte, peerKey [keySize]byte, host string) (*Certificate, error) {
+	cert, err := ParseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Key != peerKey {
+		return nil, ErrInvalidCertificate
+	}
+	err = cert.Verify(config.CertificateAuthorities, host, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// LoadRevocationList reads a revocation list. See RevocationList for the
+// format.
+func LoadRevocationList(path string) (*RevocationList, error) {
+	rl := &RevocationList{}
+	rl.file = watchedFile{path: path, parse: rl.parse}
+	err := rl.reload()
+	if err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// Revoked returns true if key has been revoked
+func (rl *RevocationList) Revoked(key [keySize]byte) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	// unlike the authorized keys a broken or missing file leaves the keys
+	// we already have revoked
+	rl.file.reloadIfChanged()
+
+	return rl.keys[key]
+}
+
+func (rl *RevocationList) reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.file.reloadIfChanged()
+}
+
+func (rl *RevocationList) parse(r io.Reader) error {
+	revoked, err := ParseRevocationList(r)
+	if err != nil {
+		return err
+	}
+	keys := make(map[[keySize]byte]bool, len(revoked))
+	for _, k := range revoked {
+		keys[k] = true
+	}
+	rl.keys = keys
+	return nil
+}
+
+// ParseRevocationList parses the keys in a revocation list
+func ParseRevocationList(r io.Reader) ([][keySize]byte, error) {
+	var keys [][keySize]byte
+	err := ParseLines(r, func(fields []string) error {
+		key, err := decodeKey(fields[0])
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,188 @@
+package boxconn
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCertificate(t *testing.T) {
+	authorityPub, authorityPriv, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Date(2015, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	cert := &Certificate{
+		Name:      "alice",
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(time.Hour),
+		Hosts:     []string{"a.example.com", "b.example.com"},
+	}
+	cert.Key[0] = 1
+	cert.Sign(authorityPriv)
+
+	parsed, err := ParseCertificate(cert.Marshal())
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, cert) {
+		t.Fatalf("expected %v, got %v", cert, parsed)
+	}
+
+	authorities := []ed25519.PublicKey{otherPub, authorityPub}
+	for _, tc := range []struct {
+		authorities []ed25519.PublicKey
+		host        string
+		now         time.Time
+		err         error
+	}{
+		{authorities, "a.example.com", now, nil},
+		{authorities, "B.example.com", now, nil},
+		{authorities, "", now, nil},
+		{authorities, "c.example.com", now, ErrCertificateHost},
+		{authorities, "a.example.com", now.Add(2 * time.Hour), ErrCertificateExpired},
+		{authorities, "a.example.com", now.Add(-2 * time.Hour), ErrCertificateExpired},
+		{[]ed25519.PublicKey{otherPub}, "a.example.com", now, ErrInvalidCertificate},
+	} {
+		if err := parsed.Verify(tc.authorities, tc.host, tc.now); err != tc.err {
+			t.Errorf("host %q at %v: expected %v, got %v", tc.host, tc.now, tc.err, err)
+		}
+	}
+
+	// changing anything breaks the signature
+	parsed.Name = "mallory"
+	if err := parsed.Verify(authorities, "", now); err != ErrInvalidCertificate {
+		t.Errorf("expected ErrInvalidCertificate, got %v", err)
+	}
+
+	data := cert.Marshal()
+	for _, bad := range [][]byte{nil, data[:40], data[:len(data)-1], append(data, 0)} {
+		if _, err := ParseCertificate(bad); err != ErrInvalidCertificate {
+			t.Errorf("expected ErrInvalidCertificate for %x, got %v", bad, err)
+		}
+	}
+}
+
+func TestCertificateHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boxconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	revocations := filepath.Join(dir, "revoked")
+	if err := ioutil.WriteFile(revocations, []byte("# nothing yet\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rl, err := LoadRevocationList(revocations)
+	if err != nil {
+		t.Fatalf("failed to load revocation list: %v", err)
+	}
+
+	authorityPub, authorityPriv, _ := ed25519.GenerateKey(rand.Reader)
+	configs := func(mode Mode, hosts ...string) (*Config, *Config) {
+		clientConfig, serverConfig := noiseTestConfigs(mode, NoiseBLAKE2s)
+		clientConfig.Certificate = &Certificate{
+			Key:   clientConfig.PublicKey,
+			Name:  "alice",
+			Hosts: hosts,
+		}
+		clientConfig.Certificate.Sign(authorityPriv)
+		serverConfig.KeyStore = nil
+		serverConfig.CertificateAuthorities = []ed25519.PublicKey{authorityPub}
+		serverConfig.HostName = "server.example.com"
+		serverConfig.Revocations = rl
+		return clientConfig, serverConfig
+	}
+
+	for _, mode := range []Mode{ModeBox, ModeNoiseXX, ModeNoiseIK} {
+		clientConfig, serverConfig := configs(mode, "server.example.com")
+		client, server := handshakePairConfig(t, clientConfig, serverConfig)
+		if server.PeerName() != "alice" {
+			t.Errorf("mode %d: expected the peer to be named alice, got %q", mode, server.PeerName())
+		}
+		client.Close()
+		server.Close()
+	}
+
+	handshakeError := func(clientConfig, serverConfig *Config) error {
+		c1, c2 := tcpPipe(t)
+		defer c1.Close()
+		errs := make(chan error, 1)
+		go func() {
+			_, err := HandshakeConfig(c2, serverConfig)
+			c2.Close()
+			errs <- err
+		}()
+		HandshakeConfig(c1, clientConfig)
+		return <-errs
+	}
+
+	// a certificate for another host
+	if err := handshakeError(configs(ModeNoiseXX, "other.example.com")); err != ErrCertificateHost {
+		t.Errorf("expected ErrCertificateHost, got %v", err)
+	}
+
+	// a certificate for another key
+	clientConfig, serverConfig := configs(ModeNoiseXX)
+	clientConfig.Certificate.Key[0]++
+	clientConfig.Certificate.Sign(authorityPriv)
+	if err := handshakeError(clientConfig, serverConfig); err != ErrInvalidCertificate {
+		t.Errorf("expected ErrInvalidCertificate, got %v", err)
+	}
+
+	// no certificate at all
+	clientConfig, serverConfig = configs(ModeNoiseXX)
+	clientConfig.Certificate = nil
+	if err := handshakeError(clientConfig, serverConfig); !errors.Is(err, ErrKeyNotAllowed) {
+		t.Errorf("expected ErrKeyNotAllowed, got %v", err)
+	}
+
+	// a revoked key, even with a valid certificate
+	clientConfig, serverConfig = configs(ModeNoiseXX)
+	line := base64.StdEncoding.EncodeToString(clientConfig.PublicKey[:]) + " alice's laptop\n"
+	if err := ioutil.WriteFile(revocations, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshakeError(clientConfig, serverConfig); err != ErrKeyRevoked {
+		t.Errorf("expected ErrKeyRevoked, got %v", err)
+	}
+}
+
+func TestServerCertificateHost(t *testing.T) {
+	authorityPub, authorityPriv, _ := ed25519.GenerateKey(rand.Reader)
+	clientConfig, serverConfig := noiseTestConfigs(ModeNoiseXX, NoiseBLAKE2s)
+	serverConfig.Certificate = &Certificate{
+		Key:   serverConfig.PublicKey,
+		Name:  "db1",
+		Hosts: []string{"db1.example.com"},
+	}
+	serverConfig.Certificate.Sign(authorityPriv)
+	clientConfig.KeyStore = nil
+	clientConfig.CertificateAuthorities = []ed25519.PublicKey{authorityPub}
+	// the client's own name doesn't matter for the server's certificate
+	clientConfig.HostName = "client.example.com"
+
+	dial := func(address string) error {
+		c1, c2 := tcpPipe(t)
+		defer c1.Close()
+		go func() {
+			HandshakeConfig(c2, serverConfig)
+			c2.Close()
+		}()
+		_, err := handshake(c1, clientConfig, address)
+		return err
+	}
+
+	if err := dial("db1.example.com:5000"); err != nil {
+		t.Errorf("expected the certificate to be valid for the host we dialed, got %v", err)
+	}
+	if err := dial("db2.example.com:5000"); err != ErrCertificateHost {
+		t.Errorf("expected ErrCertificateHost, got %v", err)
+	}
+}
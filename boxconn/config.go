@@ -0,0 +1,339 @@
+package boxconn
+
+import (
+	"crypto/ed25519"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultRekeyAfterBytes is the number of bytes sent before the session
+	// key is replaced when Config.RekeyAfterBytes is zero
+	DefaultRekeyAfterBytes = 1 << 30
+	// DefaultRekeyAfterMessages is the number of messages sent before the
+	// session key is replaced when Config.RekeyAfterMessages is zero
+	DefaultRekeyAfterMessages = 1 << 24
+	// DefaultRekeyAfterDuration is how long a session key is used before it
+	// is replaced when Config.RekeyAfterDuration is zero
+	DefaultRekeyAfterDuration = time.Hour
+
+	// DefaultHandshakeTimeout is the time a Listener gives a handshake to
+	// complete when Config.HandshakeTimeout is zero
+	DefaultHandshakeTimeout = 10 * time.Second
+	// DefaultMaxPendingHandshakes is the number of handshakes a Listener runs
+	// at once when Config.MaxPendingHandshakes is zero
+	DefaultMaxPendingHandshakes = 128
+
+	// DefaultMaxHandshakeFailures is the number of failed handshakes after
+	// which a Listener bans a remote IP when Config.MaxHandshakeFailures is
+	// zero
+	DefaultMaxHandshakeFailures = 10
+	// DefaultHandshakeFailureWindow is how long failed handshakes are
+	// counted when Config.HandshakeFailureWindow is zero
+	DefaultHandshakeFailureWindow = time.Minute
+	// DefaultBanDuration is how long the first ban of a remote IP lasts when
+	// Config.BanDuration is zero
+	DefaultBanDuration = time.Minute
+	// DefaultMaxBanDuration is the longest a ban lasts when
+	// Config.MaxBanDuration is zero
+	DefaultMaxBanDuration = time.Hour
+
+	// DefaultMaxFrameSize is the largest frame we accept when
+	// Config.MaxFrameSize is zero
+	DefaultMaxFrameSize = 1 << 20
+	// MinFrameSize is the smallest allowed Config.MaxFrameSize. Handshake
+	// messages have to fit in a single frame.
+	MinFrameSize = 1024
+	// MinPreSharedKeySize is the shortest allowed Config.PreSharedKey
+	MinPreSharedKeySize = 32
+
+	// DefaultFlushDelay is how long buffered writes wait before they are
+	// sent when Config.FlushDelay is zero
+	DefaultFlushDelay = time.Millisecond
+
+	// DefaultPaddingBlockSize is the block size of PaddingBlock when
+	// Config.PaddingSize is zero
+	DefaultPaddingBlockSize = 256
+	// DefaultPaddingFrameSize is the frame size of PaddingConstant when
+	// Config.PaddingSize is zero
+	DefaultPaddingFrameSize = MinFrameSize
+)
+
+// Mode selects the handshake used to establish a session
+type Mode int
+
+const (
+	// ModeBox is the original boxconn handshake: both sides send their
+	// static and ephemeral keys and prove they derived the same session
+	// keys by trading session tokens
+	ModeBox Mode = iota
+	// ModeNoiseXX is the Noise XX pattern. Both sides send their static
+	// keys during the handshake, encrypted.
+	ModeNoiseXX
+	// ModeNoiseIK is the Noise IK pattern. The initiator must know the
+	// responder's key in advance, see Config.PeerKey, and saves a round
+	// trip.
+	ModeNoiseIK
+)
+
+// NoiseHash selects the hash function used by the Noise handshakes
+type NoiseHash int
+
+const (
+	// NoiseBLAKE2s is BLAKE2s, the default
+	NoiseBLAKE2s NoiseHash = iota
+	// NoiseSHA256 is SHA256
+	NoiseSHA256
+)
+
+type (
+	// Config configures a session. Dial, Listen and Handshake build one from
+	// their arguments, use DialConfig, ListenConfig and HandshakeConfig to
+	// change any of the other settings.
+	Config struct {
+		// PrivateKey and PublicKey are our long-term keys
+		PrivateKey, PublicKey [keySize]byte
+		// KeyStore decides which peer keys are allowed for the session. Use
+		// KeyList for a fixed list of keys or LoadAuthorizedKeys for a file.
+		KeyStore KeyStore
+
+		// Mode selects the handshake. Both sides must use the same one. The
+		// zero value is ModeBox.
+		Mode Mode
+		// NoiseHash selects the hash function of the Noise handshakes. Both
+		// sides must use the same one.
+		NoiseHash NoiseHash
+		// Initiator says which side of a Noise handshake we are on. Dial and
+		// DialConfig always initiate and a Listener always responds, so it
+		// only matters for HandshakeConfig.
+		Initiator bool
+		// PeerKey is the responder's public key, which the initiator of a
+		// ModeNoiseIK handshake has to know in advance. It must also be
+		// allowed by KeyStore.
+		PeerKey [keySize]byte
+
+		// Certificate, if set, is sent to the peer during the handshake. A
+		// peer which trusts the authority that signed it allows us without
+		// knowing our key. Its Key must be PublicKey.
+		Certificate *Certificate
+		// CertificateAuthorities are the authorities whose certificates we
+		// accept. Peers with a valid certificate are allowed even if the
+		// KeyStore doesn't know them, and are named after the certificate.
+		CertificateAuthorities []ed25519.PublicKey
+		// HostName is checked against the hosts a client's certificate is
+		// limited to. Empty means use os.Hostname. The initiator checks the
+		// server's certificate against the host it connected to instead.
+		HostName string
+		// Revocations, if set, lists keys which are never allowed, whether
+		// the KeyStore knows them or they have a certificate. Use
+		// LoadRevocationList to load it from a file.
+		Revocations *RevocationList
+
+		// KnownHosts, if set, allows servers we haven't connected to before
+		// and remembers their keys, see KnownHosts. Keys allowed by KeyStore
+		// don't need it. It is only used when we know the address we
+		// connected to, that is by Dial, DialConfig and HandshakeConfig.
+		KnownHosts *KnownHosts
+
+		// PreSharedKey, if set, is a secret shared by both sides which is
+		// mixed into the session keys along with the Curve25519 results. As
+		// long as it stays secret recorded sessions can't be decrypted even
+		// if Curve25519 is broken. It must be at least MinPreSharedKeySize
+		// random bytes. Nothing derived from it is sent in the clear, a
+		// side with a different key only finds out when the first message
+		// sealed with the session keys doesn't decrypt, and fails with
+		// ErrPreSharedKeyMismatch. The Noise modes mix it in before the last
+		// handshake message rather than with Noise's psk modifier, so they
+		// are no longer standard Noise when it is set.
+		PreSharedKey []byte
+
+		// RekeyAfterBytes, RekeyAfterMessages and RekeyAfterDuration control
+		// how long a session key is used for writing. Once any of the limits
+		// is reached the key is replaced by one derived from it and the peer
+		// is told to do the same. Zero means use the default, a negative
+		// duration disables the time limit.
+		RekeyAfterBytes    uint64
+		RekeyAfterMessages uint64
+		RekeyAfterDuration time.Duration
+
+		// HandshakeTimeout is how long a Listener waits for a handshake to
+		// complete. Zero means use the default, a negative duration disables
+		// the timeout.
+		HandshakeTimeout time.Duration
+		// MaxPendingHandshakes is the number of handshakes a Listener runs
+		// at once. Once it is reached no new connections are accepted until
+		// one of the handshakes finishes. Zero means use the default.
+		MaxPendingHandshakes int
+		// HandshakeFailed, if set, is called by a Listener whenever a
+		// handshake fails. The connection has already been closed. Use
+		// errors.Is and errors.As to find out why it failed, for example
+		// an unknown peer gives a *KeyNotAllowedError.
+		HandshakeFailed func(addr net.Addr, err error)
+
+		// MaxHandshakeFailures is the number of handshakes from one remote
+		// IP which may fail within HandshakeFailureWindow. After that a
+		// Listener bans the IP for BanDuration, and closes its connections
+		// right away with ErrBanned. Every ban in a row lasts twice as long
+		// as the one before, up to MaxBanDuration. See Listener.Bans. Zero
+		// means use the defaults, a negative value disables bans.
+		MaxHandshakeFailures   int
+		HandshakeFailureWindow time.Duration
+		BanDuration            time.Duration
+		MaxBanDuration         time.Duration
+
+		// TrustedProxies are the networks of load balancers which send a
+		// PROXY protocol header, version 1 or 2, before the handshake. A
+		// Listener reads the header from connections coming from them and
+		// reports the client address in it as the connection's RemoteAddr,
+		// which is also the address bans apply to. After a header without a
+		// client address, like those of the balancer's health checks, the
+		// handshake goes ahead with the balancer's address. Addresses in
+		// these networks are never banned. Connections from anywhere else are never expected to send
+		// a header.
+		TrustedProxies []*net.IPNet
+
+		// MaxFrameSize is the largest frame, as written on the wire, which
+		// we read from the peer. It counts everything: the nonce and length
+		// in front of the frame, the record header, the data, any padding
+		// and the authenticator. Larger frames are rejected before anything
+		// is allocated for them. Both sides tell each other their limit
+		// during the handshake and split writes into frames the other side
+		// accepts. Zero means use the default.
+		MaxFrameSize int
+
+		// WriteBufferSize turns on write coalescing. Small writes are
+		// collected into a single frame until WriteBufferSize bytes are
+		// buffered, FlushDelay has passed or Flush is called. Zero, the
+		// default, writes every Write as its own frame.
+		WriteBufferSize int
+		// FlushDelay is how long buffered writes wait before they are sent.
+		// Zero means use the default.
+		FlushDelay time.Duration
+
+		// Padding pads written frames so their length reveals less about
+		// what's in them, if the peer supports it. Padding is sealed along
+		// with the data and checked when it is removed.
+		Padding Padding
+		// PaddingSize is the block size of PaddingBlock and the frame size,
+		// as written on the wire, of PaddingConstant. Zero means use the
+		// default. Frames are never padded beyond what the peer accepts.
+		PaddingSize int
+
+		// Tracer, if set, receives events about the session. Use
+		// NewLogTracer to write them to a log.Logger.
+		Tracer Tracer
+	}
+)
+
+func newConfig(privateKey, publicKey [keySize]byte, allowedKeys [][keySize]byte) *Config {
+	return &Config{
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+		KeyStore:   KeyList(allowedKeys),
+	}
+}
+
+// withInitiator returns config with Initiator set, copying it if needed
+func (c *Config) withInitiator(initiator bool) *Config {
+	if c.Initiator == initiator {
+		return c
+	}
+	copied := *c
+	copied.Initiator = initiator
+	return &copied
+}
+
+func (c *Config) rekeyAfterBytes() uint64 {
+	if c.RekeyAfterBytes == 0 {
+		return DefaultRekeyAfterBytes
+	}
+	return c.RekeyAfterBytes
+}
+
+func (c *Config) rekeyAfterMessages() uint64 {
+	if c.RekeyAfterMessages == 0 {
+		return DefaultRekeyAfterMessages
+	}
+	return c.RekeyAfterMessages
+}
+
+func (c *Config) rekeyAfterDuration() time.Duration {
+	if c.RekeyAfterDuration == 0 {
+		return DefaultRekeyAfterDuration
+	}
+	return c.RekeyAfterDuration
+}
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c.HandshakeTimeout == 0 {
+		return DefaultHandshakeTimeout
+	}
+	return c.HandshakeTimeout
+}
+
+func (c *Config) maxPendingHandshakes() int {
+	if c.MaxPendingHandshakes <= 0 {
+		return DefaultMaxPendingHandshakes
+	}
+	return c.MaxPendingHandshakes
+}
+
+func (c *Config) maxHandshakeFailures() int {
+	if c.MaxHandshakeFailures == 0 {
+		return DefaultMaxHandshakeFailures
+	}
+	return c.MaxHandshakeFailures
+}
+
+func (c *Config) handshakeFailureWindow() time.Duration {
+	if c.HandshakeFailureWindow <= 0 {
+		return DefaultHandshakeFailureWindow
+	}
+	return c.HandshakeFailureWindow
+}
+
+func (c *Config) banDuration() time.Duration {
+	if c.BanDuration <= 0 {
+		return DefaultBanDuration
+	}
+	return c.BanDuration
+}
+
+func (c *Config) maxBanDuration() time.Duration {
+	if c.MaxBanDuration <= 0 {
+		return DefaultMaxBanDuration
+	}
+	return c.MaxBanDuration
+}
+
+func (c *Config) maxFrameSize() int {
+	switch {
+	case c.MaxFrameSize == 0:
+		return DefaultMaxFrameSize
+	case c.MaxFrameSize < MinFrameSize:
+		return MinFrameSize
+	}
+	return c.MaxFrameSize
+}
+
+func (c *Config) flushDelay() time.Duration {
+	if c.FlushDelay <= 0 {
+		return DefaultFlushDelay
+	}
+	return c.FlushDelay
+}
+
+func (c *Config) hostName() (string, error) {
+	if c.HostName != "" {
+		return c.HostName, nil
+	}
+	return os.Hostname()
+}
+
+func (c *Config) tracer() Tracer {
+	if c == nil || c.Tracer == nil {
+		return NopTracer
+	}
+	return c.Tracer
+}
@@ -4,19 +4,47 @@
 package boxconn
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
+// closeTimeout is how long Close waits to tell the peer the session is over
+const closeTimeout = 5 * time.Second
+
+// aLongTimeAgo is a deadline in the past, setting it unblocks any Read or
+// Write on a connection
+var aLongTimeAgo = time.Unix(1, 0)
+
 type (
-	// Conn is a secure connection over an underlying net.Conn
+	// Conn is a secure connection over an underlying net.Conn. Like any
+	// net.Conn it may be used from multiple goroutines at the same time.
 	Conn struct {
 		underlying net.Conn
-		recvBuffer []byte
 		protocol   *Protocol
+
+		// readBuffer holds the last frame read, which recvBuffer may point
+		// into, or the record box opened from it. Both go back to the pool
+		// once recvBuffer is empty.
+		readMu     sync.Mutex
+		recvBuffer []byte
+		readHeader [frameHeaderSize]byte
+		readBuffer *[]byte
+
+		// writeMu keeps the frames of a single Write together and guards the
+		// write buffer, see Config.WriteBufferSize
+		writeMu     sync.Mutex
+		writeBuffer []byte
+		writeErr    error
+		flushTimer  *time.Timer
+
+		// writeDeadline is the caller's write deadline, Close won't wait
+		// past it to send the close record
+		deadlineMu    sync.Mutex
+		writeDeadline time.Time
 	}
 )
 
@@ -30,32 +58,155 @@ func Dial(network, address string, privateKey, publicKey [keySize]byte, allowedK
 	return Handshake(conn, privateKey, publicKey, allowedKeys...)
 }
 
+// DialConfig is like Dial but takes its keys and settings from config. We
+// are always the initiator of a Noise handshake.
+func DialConfig(network, address string, config *Config) (*Conn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return handshake(conn, config.withInitiator(true), address)
+}
+
+// DialContext is like DialConfig but gives up when ctx is done, whether
+// that happens while dialing or during any step of the handshake. The
+// connection is closed and ctx.Err() is returned, that is context.Canceled
+// or context.DeadlineExceeded. Once DialContext returns ctx no longer
+// affects the connection.
+func DialContext(ctx context.Context, network, address string, config *Config) (*Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	c, err := handshakeContext(ctx, conn, config.withInitiator(true), address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
 // Handshake establishes a session between two parties. Keys can be generated
 // using box.GenerateKeys. allowedKeys is a list of keys which are allowed
 // for the session.
 func Handshake(conn net.Conn, privateKey, publicKey [keySize]byte, allowedKeys ...[keySize]byte) (*Conn, error) {
+	return HandshakeConfig(conn, newConfig(privateKey, publicKey, allowedKeys))
+}
+
+// HandshakeConfig is like Handshake but takes its keys and settings from
+// config
+func HandshakeConfig(conn net.Conn, config *Config) (*Conn, error) {
+	return handshake(conn, config, conn.RemoteAddr().String())
+}
+
+// HandshakeContext is like HandshakeConfig but gives up when ctx is done.
+// The connection is closed and ctx.Err() is returned, that is
+// context.Canceled or context.DeadlineExceeded. Any other error leaves the
+// connection open, just like HandshakeConfig.
+func HandshakeContext(ctx context.Context, conn net.Conn, config *Config) (*Conn, error) {
+	return handshakeContext(ctx, conn, config, conn.RemoteAddr().String())
+}
+
+// handshakeContext runs handshake until ctx is done. The deadline of ctx is
+// set on conn, and cancellation sets a deadline in the past, so a stalled
+// peer can't block any step for longer.
+func handshakeContext(ctx context.Context, conn net.Conn, config *Config, address string) (*Conn, error) {
+	if ctx.Done() == nil {
+		return handshake(conn, config, address)
+	}
+	if err := ctx.Err(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+
+	c, err := handshake(conn, config, address)
+	close(stop)
+	<-stopped
+
+	ctxErr := ctx.Err()
+	// the deadline may pass a moment before ctx notices
+	if ctxErr == nil && err != nil && hasDeadline && !time.Now().Before(deadline) {
+		ctxErr = context.DeadlineExceeded
+	}
+	if ctxErr != nil {
+		conn.Close()
+		return nil, ctxErr
+	}
+	if hasDeadline {
+		if derr := conn.SetDeadline(time.Time{}); err == nil {
+			err = derr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// handshake establishes a session with the peer at address, the address is
+// what Config.KnownHosts remembers the peer's key by
+func handshake(conn net.Conn, config *Config, address string) (*Conn, error) {
 	c := &Conn{
 		underlying: conn,
 	}
 	c.protocol = NewProtocol(c, c)
+	c.protocol.peerAddress = address
 
-	return c, c.protocol.Handshake(privateKey, publicKey, allowedKeys...)
+	return c, c.protocol.HandshakeConfig(config)
 }
 
 // ReadMessage reads a message (nonce, data) from the connection
 func (c *Conn) ReadMessage() (Message, error) {
-	header := make([]byte, nonceSize+lenSize)
-	_, err := io.ReadFull(c.underlying, header)
+	var msg Message
+	length, err := c.readFrameHeader(&msg.Nonce)
 	if err != nil {
 		return Message{}, err
 	}
 
-	var msg Message
-	copy(msg.Nonce[:], header[:nonceSize])
+	msg.Data = make([]byte, length)
+	_, err = io.ReadFull(c.underlying, msg.Data)
+	if err != nil {
+		return Message{}, err
+	}
+	return msg, nil
+}
 
-	length := int(binary.BigEndian.Uint64(header[nonceSize:]))
+// readFrame is like ReadMessage but reads the data into readBuffer, so it
+// is only valid until the next read
+func (c *Conn) readFrame() (Message, error) {
+	var msg Message
+	length, err := c.readFrameHeader(&msg.Nonce)
+	if err != nil {
+		return Message{}, err
+	}
 
-	msg.Data = make([]byte, length)
+	if c.readBuffer != nil && cap(*c.readBuffer) < length {
+		putBuffer(c.readBuffer)
+		c.readBuffer = nil
+	}
+	if c.readBuffer == nil {
+		c.readBuffer = getBuffer(length)
+	}
+	msg.Data = (*c.readBuffer)[:length]
 	_, err = io.ReadFull(c.underlying, msg.Data)
 	if err != nil {
 		return Message{}, err
@@ -63,12 +214,45 @@ func (c *Conn) ReadMessage() (Message, error) {
 	return msg, nil
 }
 
+// readFrameHeader reads the nonce and length of the next frame
+func (c *Conn) readFrameHeader(nonce *[nonceSize]byte) (int, error) {
+	_, err := io.ReadFull(c.underlying, c.readHeader[:])
+	if err != nil {
+		return 0, err
+	}
+	copy(nonce[:], c.readHeader[:nonceSize])
+
+	length := binary.BigEndian.Uint64(c.readHeader[nonceSize:])
+	if max := uint64(c.protocol.config.maxFrameSize()); length > max-frameHeaderSize {
+		return 0, &FrameTooLargeError{length + frameHeaderSize, max}
+	}
+	return int(length), nil
+}
+
+// releaseReadBuffer gives the last frame, and the record box opened from
+// it, back to the pool. readMu must be held.
+func (c *Conn) releaseReadBuffer() {
+	if c.readBuffer != nil {
+		putBuffer(c.readBuffer)
+		c.readBuffer = nil
+	}
+	c.protocol.releaseOpened()
+}
+
 // WriteMessage writes a message (nonce, data) to the connection
 func (c *Conn) WriteMessage(msg Message) error {
-	header := make([]byte, nonceSize+lenSize)
-	copy(header[:nonceSize], msg.Nonce[:])
-	binary.BigEndian.PutUint64(header[nonceSize:], uint64(len(msg.Data)))
-	_, err := io.Copy(c.underlying, io.MultiReader(bytes.NewReader(header), bytes.NewReader(msg.Data)))
+	buf := getBuffer(frameHeaderSize + len(msg.Data))
+	defer putBuffer(buf)
+	copy((*buf)[frameHeaderSize:], msg.Data)
+	return c.writeFrame(&msg.Nonce, *buf)
+}
+
+// writeFrame fills in the header in front of the data in frame and writes
+// the frame with a single write
+func (c *Conn) writeFrame(nonce *[nonceSize]byte, frame []byte) error {
+	copy(frame, nonce[:])
+	binary.BigEndian.PutUint64(frame[nonceSize:], uint64(len(frame)-frameHeaderSize))
+	_, err := c.underlying.Write(frame)
 	return err
 }
 
@@ -76,21 +260,30 @@ func (c *Conn) WriteMessage(msg Message) error {
 // Read can be made to time out and return a Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetReadDeadline.
 func (c *Conn) Read(b []byte) (n int, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
 	// if we have anything left over from the last read
 	if len(c.recvBuffer) > 0 {
 		copied := copy(b, c.recvBuffer)
 		c.recvBuffer = c.recvBuffer[copied:]
+		if len(c.recvBuffer) == 0 {
+			c.releaseReadBuffer()
+		}
 		return copied, nil
 	}
 
-	msg, err := c.protocol.Read()
+	msg, err := c.protocol.read()
 	if err != nil {
+		c.releaseReadBuffer()
 		return 0, err
 	}
 
 	copied := copy(b, msg)
 	if copied < len(msg) {
 		c.recvBuffer = msg[copied:]
+	} else {
+		c.releaseReadBuffer()
 	}
 	return copied, nil
 }
@@ -98,17 +291,155 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 // Write writes data to the connection.
 // Write can be made to time out and return a Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetWriteDeadline.
+//
+// Writes larger than Config.MaxFrameSize are split into multiple frames.
+// If Config.WriteBufferSize is set small writes are buffered, see Flush.
 func (c *Conn) Write(b []byte) (n int, err error) {
-	err = c.protocol.Write(b)
-	if err != nil {
-		return 0, err
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	size := c.writeBufferSize()
+	if size == 0 {
+		return c.writeFrames(b)
+	}
+
+	// an error from a delayed flush is reported by the next write
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+
+	if len(c.writeBuffer)+len(b) > size {
+		err = c.flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(b) >= size {
+		return c.writeFrames(b)
+	}
+
+	c.writeBuffer = append(c.writeBuffer, b...)
+	if c.flushTimer == nil {
+		c.flushTimer = time.AfterFunc(c.protocol.config.flushDelay(), func() {
+			c.writeMu.Lock()
+			defer c.writeMu.Unlock()
+			c.writeErr = c.flush()
+		})
 	}
 	return len(b), nil
 }
 
-// Close closes the connection.
-// Any blocked Read or Write operations will be unblocked and return errors.
+// Flush writes any buffered data to the connection. It does nothing unless
+// Config.WriteBufferSize is set.
+func (c *Conn) Flush() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	return c.flush()
+}
+
+// flush writes out the write buffer. writeMu must be held.
+func (c *Conn) flush() error {
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	if len(c.writeBuffer) == 0 {
+		return nil
+	}
+	_, err := c.writeFrames(c.writeBuffer)
+	c.writeBuffer = c.writeBuffer[:0]
+	return err
+}
+
+// writeBufferSize is the size at which buffered writes are flushed, zero
+// if writes aren't buffered
+func (c *Conn) writeBufferSize() int {
+	size := c.protocol.config.WriteBufferSize
+	if max := c.protocol.maxRecordSize(); size > max {
+		size = max
+	}
+	if size < 0 {
+		size = 0
+	}
+	return size
+}
+
+// writeFrames writes b as one or more frames
+func (c *Conn) writeFrames(b []byte) (n int, err error) {
+	max := c.protocol.maxRecordSize()
+	for {
+		chunk := b[n:]
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		err = c.protocol.Write(chunk)
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		if n == len(b) {
+			return n, nil
+		}
+	}
+}
+
+// CloseWrite flushes any buffered writes and tells the peer we won't write
+// anything else, then shuts down the writing side of the underlying
+// connection if it supports it. The peer's Read returns io.EOF once it has
+// read everything we wrote.
+func (c *Conn) CloseWrite() error {
+	c.writeMu.Lock()
+	err := c.closeWrite()
+	c.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if cw, ok := c.underlying.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// closeWrite flushes buffered writes and sends the close record. writeMu
+// must be held.
+func (c *Conn) closeWrite() error {
+	if c.writeErr == nil {
+		c.writeErr = c.flush()
+	}
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	return c.protocol.CloseWrite()
+}
+
+// Close closes the connection. Buffered writes are flushed and the peer is
+// told the session is over, so its Read returns io.EOF rather than
+// ErrTruncated. Any blocked Read or Write operations will be unblocked and
+// return errors.
 func (c *Conn) Close() error {
+	// if a write is blocked there's no point waiting for it
+	if c.protocol.isEstablished() && c.writeMu.TryLock() {
+		// don't wait forever for a peer which isn't reading, nor longer
+		// than the caller would have waited for a write
+		deadline := time.Now().Add(closeTimeout)
+		c.deadlineMu.Lock()
+		if !c.writeDeadline.IsZero() && c.writeDeadline.Before(deadline) {
+			deadline = c.writeDeadline
+		}
+		c.deadlineMu.Unlock()
+		if time.Now().Before(deadline) {
+			c.underlying.SetWriteDeadline(deadline)
+			c.closeWrite()
+		}
+		c.writeMu.Unlock()
+	}
 	return c.underlying.Close()
 }
 
@@ -136,6 +467,9 @@ func (c *Conn) RemoteAddr() net.Addr {
 //
 // A zero value for t means I/O operations will not time out.
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.writeDeadline = t
+	c.deadlineMu.Unlock()
 	return c.underlying.SetDeadline(t)
 }
 
@@ -150,5 +484,8 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 // some of the data was successfully written.
 // A zero value for t means Write will not time out.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.writeDeadline = t
+	c.deadlineMu.Unlock()
 	return c.underlying.SetWriteDeadline(t)
 }
@@ -3,11 +3,18 @@ package boxconn
 import (
 	"bytes"
 	"code.google.com/p/go.crypto/nacl/box"
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type replayConn struct {
@@ -122,3 +129,691 @@ func TestConn(t *testing.T) {
 		t.Errorf("replay should not succeed but it did")
 	}
 }
+
+// tcpPipe returns both ends of a loopback TCP connection. Unlike net.Pipe
+// writes are buffered, so both sides can send their hello at the same time.
+func tcpPipe(t testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- c
+	}()
+
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	c2 := <-accepted
+	if c2 == nil {
+		t.Fatalf("failed to accept")
+	}
+	return c1, c2
+}
+
+// handshakePair establishes a session between two fresh key pairs
+func handshakePair(t *testing.T) (*Conn, *Conn) {
+	skPub, skPriv, _ := box.GenerateKey(rand.Reader)
+	ckPub, ckPriv, _ := box.GenerateKey(rand.Reader)
+	return handshakePairKeys(t, *skPriv, *skPub, *ckPriv, *ckPub)
+}
+
+func handshakePairKeys(t *testing.T, skPriv, skPub, ckPriv, ckPub [keySize]byte) (*Conn, *Conn) {
+	return handshakePairConfig(t,
+		newConfig(ckPriv, ckPub, [][keySize]byte{skPub}),
+		newConfig(skPriv, skPub, [][keySize]byte{ckPub}))
+}
+
+// testConfigs returns a client and server config which allow each other
+func testConfigs() (*Config, *Config) {
+	skPub, skPriv, _ := box.GenerateKey(rand.Reader)
+	ckPub, ckPriv, _ := box.GenerateKey(rand.Reader)
+	return newConfig(*ckPriv, *ckPub, [][keySize]byte{*skPub}),
+		newConfig(*skPriv, *skPub, [][keySize]byte{*ckPub})
+}
+
+func handshakePairConfig(t testing.TB, clientConfig, serverConfig *Config) (*Conn, *Conn) {
+	c1, c2 := tcpPipe(t)
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		bc, err := HandshakeConfig(c2, serverConfig)
+		results <- result{bc, err}
+	}()
+
+	client, err := HandshakeConfig(c1, clientConfig)
+	if err != nil {
+		t.Fatalf("client handshake failed: %v", err)
+	}
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("server handshake failed: %v", res.err)
+	}
+	return client, res.conn
+}
+
+func TestHandshakeSessionKeys(t *testing.T) {
+	skPub, skPriv, _ := box.GenerateKey(rand.Reader)
+	ckPub, ckPriv, _ := box.GenerateKey(rand.Reader)
+
+	client, server := handshakePairKeys(t, *skPriv, *skPub, *ckPriv, *ckPub)
+	defer client.Close()
+	defer server.Close()
+
+	if client.protocol.sendKey != server.protocol.recvKey || client.protocol.recvKey != server.protocol.sendKey {
+		t.Fatalf("expected both sides to agree on the session keys")
+	}
+	if client.protocol.sendKey == client.protocol.recvKey {
+		t.Errorf("expected different keys for each direction")
+	}
+
+	// the same static keys must not give the same session keys again
+	client2, server2 := handshakePairKeys(t, *skPriv, *skPub, *ckPriv, *ckPub)
+	defer client2.Close()
+	defer server2.Close()
+
+	if client.protocol.sendKey == client2.protocol.sendKey {
+		t.Errorf("expected a fresh session key for every session")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	clientConfig.RekeyAfterMessages = 3
+	serverConfig.RekeyAfterBytes = 10
+
+	client, server := handshakePairConfig(t, clientConfig, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	clientKey := client.protocol.sendKey
+	serverKey := server.protocol.sendKey
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			client.Write([]byte("from client"))
+			server.Write([]byte("from server"))
+		}
+	}()
+
+	buf := make([]byte, 1024)
+	for i := 0; i < 10; i++ {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if string(buf[:n]) != "from client" {
+			t.Fatalf("expected %q, got %q", "from client", buf[:n])
+		}
+		n, err = client.Read(buf)
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if string(buf[:n]) != "from server" {
+			t.Fatalf("expected %q, got %q", "from server", buf[:n])
+		}
+	}
+
+	<-done
+
+	if client.protocol.sendKey == clientKey || server.protocol.sendKey == serverKey {
+		t.Errorf("expected the session keys to be replaced")
+	}
+	if client.protocol.sendKey != server.protocol.recvKey || server.protocol.sendKey != client.protocol.recvKey {
+		t.Errorf("expected both sides to agree on the new keys")
+	}
+}
+
+func TestListenerConcurrentHandshakes(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	serverConfig.HandshakeTimeout = 200 * time.Millisecond
+	failed := make(chan error, 1)
+	serverConfig.HandshakeFailed = func(addr net.Addr, err error) {
+		failed <- err
+	}
+
+	l, err := ListenConfig("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	// a client which never says anything
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer silent.Close()
+
+	go func() {
+		c, err := DialConfig("tcp", l.Addr().String(), clientConfig)
+		if err != nil {
+			t.Errorf("failed to dial: %v", err)
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("Hello World"))
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer c.Close()
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "Hello World" {
+		t.Errorf("expected %q, got %q %v", "Hello World", buf[:n], err)
+	}
+
+	select {
+	case err := <-failed:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("expected a timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the silent client's handshake to time out")
+	}
+
+	l.Close()
+	_, err = l.Accept()
+	if err == nil {
+		t.Errorf("expected Accept to fail after Close")
+	}
+}
+
+func TestTracer(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+
+	var logged bytes.Buffer
+	clientConfig.Tracer = NewLogTracer(log.New(&logged, "", 0))
+	var events []Event
+	serverConfig.Tracer = TracerFunc(func(evt Event) {
+		events = append(events, evt)
+	})
+
+	client, server := handshakePairConfig(t, clientConfig, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	secret := "this is a secret message"
+	client.Write([]byte(secret))
+	buf := make([]byte, 1024)
+	server.Read(buf)
+
+	if len(events) == 0 || events[0].Type != HandshakeStart {
+		t.Fatalf("expected the first event to be %v, got %v", HandshakeStart, events)
+	}
+	finished := false
+	for _, evt := range events {
+		if evt.Type == HandshakeFinish {
+			finished = true
+			if evt.Err != nil || evt.PeerKey != clientConfig.PublicKey {
+				t.Errorf("unexpected handshake event: %v", evt)
+			}
+		}
+	}
+	if !finished {
+		t.Errorf("expected a %v event", HandshakeFinish)
+	}
+
+	out := logged.String()
+	if !strings.Contains(out, "handshake-finish") {
+		t.Errorf("expected the handshake to be logged, got %q", out)
+	}
+	for _, leak := range []string{
+		secret,
+		fmt.Sprint(clientConfig.PrivateKey),
+		fmt.Sprintf("%x", clientConfig.PrivateKey[:8]),
+		fmt.Sprintf("%x", client.protocol.sendKey[:8]),
+	} {
+		if strings.Contains(out, leak) {
+			t.Errorf("expected the log not to contain %q", leak)
+		}
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	serverConfig.KeyStore = KeyList{}
+	failed := make(chan error, 1)
+	serverConfig.HandshakeFailed = func(addr net.Addr, err error) {
+		failed <- err
+	}
+
+	l, err := ListenConfig("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	_, err = DialConfig("tcp", l.Addr().String(), clientConfig)
+	if err == nil {
+		t.Errorf("expected the handshake to fail")
+	}
+
+	err = <-failed
+	if !errors.Is(err, ErrKeyNotAllowed) {
+		t.Errorf("expected %v, got %v", ErrKeyNotAllowed, err)
+	}
+	var knae *KeyNotAllowedError
+	if !errors.As(err, &knae) || knae.Key != clientConfig.PublicKey {
+		t.Errorf("expected the client's key in the error, got %v", err)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	client, server := handshakePair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// corrupt a message
+	client.protocol.nextNonce()
+	client.WriteMessage(Message{Nonce: client.protocol.myNonce, Data: []byte("not sealed at all")})
+	_, err := server.Read(make([]byte, 1024))
+	if !errors.Is(err, ErrDecrypt) {
+		t.Errorf("expected %v, got %v", ErrDecrypt, err)
+	}
+
+	// skip a nonce
+	client.protocol.nextNonce()
+	client.Write([]byte("Hello World"))
+	_, err = server.Read(make([]byte, 1024))
+	if !errors.Is(err, ErrInvalidNonce) {
+		t.Errorf("expected %v, got %v", ErrInvalidNonce, err)
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	clientConfig.MaxFrameSize = MinFrameSize
+	serverConfig.MaxFrameSize = MinFrameSize
+	frames, largest := 0, 0
+	clientConfig.Tracer = TracerFunc(func(evt Event) {
+		if evt.Type == FrameWritten {
+			if evt.Size > largest {
+				largest = evt.Size
+			}
+			frames++
+		}
+	})
+
+	client, server := handshakePairConfig(t, clientConfig, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	data := make([]byte, 10*MinFrameSize)
+	rand.Read(data)
+	frames = 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := client.Write(data)
+		if err != nil || n != len(data) {
+			t.Errorf("expected to write %v bytes, wrote %v: %v", len(data), n, err)
+		}
+	}()
+
+	received := make([]byte, len(data))
+	_, err := io.ReadFull(server, received)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if !bytes.Equal(data, received) {
+		t.Errorf("expected to receive what was written")
+	}
+	<-done
+	if frames <= 10 {
+		t.Errorf("expected the write to be split into more than 10 frames, got %v", frames)
+	}
+	// the header counts towards the limit
+	if largest+frameHeaderSize > MinFrameSize {
+		t.Errorf("expected frames no larger than %v, got %v", MinFrameSize, largest+frameHeaderSize)
+	}
+
+	// a client which ignores the server's limit
+	client.protocol.sendFrameSize = 2 * MinFrameSize
+	go client.Write(data)
+	_, err = server.Read(received)
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("expected %v, got %v", ErrFrameTooLarge, err)
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	clientConfig.WriteBufferSize = 100
+	clientConfig.FlushDelay = time.Hour
+	frames := 0
+	clientConfig.Tracer = TracerFunc(func(evt Event) {
+		if evt.Type == FrameWritten {
+			frames++
+		}
+	})
+
+	client, server := handshakePairConfig(t, clientConfig, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	frames = 0
+	for i := 0; i < 10; i++ {
+		client.Write([]byte("0123456789"))
+	}
+	if frames != 0 {
+		t.Errorf("expected the writes to be buffered, got %v frames", frames)
+	}
+	client.Write([]byte("a"))
+	if frames != 1 {
+		t.Errorf("expected the full buffer to be written as one frame, got %v frames", frames)
+	}
+	client.Flush()
+	if frames != 2 {
+		t.Errorf("expected Flush to write a frame, got %v frames", frames)
+	}
+
+	buf := make([]byte, 1024)
+	n, _ := server.Read(buf)
+	if n != 100 {
+		t.Errorf("expected to read 100 bytes, got %v", n)
+	}
+	n, _ = server.Read(buf)
+	if string(buf[:n]) != "a" {
+		t.Errorf("expected %q, got %q", "a", buf[:n])
+	}
+
+	// writes are flushed after the delay
+	client.protocol.config.FlushDelay = time.Millisecond
+	client.Write([]byte("b"))
+	n, _ = server.Read(buf)
+	if string(buf[:n]) != "b" {
+		t.Errorf("expected %q, got %q", "b", buf[:n])
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	clientConfig.RekeyAfterMessages = 50
+	client, server := handshakePairConfig(t, clientConfig, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	// record every nonce the client uses
+	var mu sync.Mutex
+	nonces := make(map[[nonceSize]byte]bool)
+	reused := false
+	client.protocol.writer = WriterFunc(func(msg Message) error {
+		mu.Lock()
+		if nonces[msg.Nonce] {
+			reused = true
+		}
+		nonces[msg.Nonce] = true
+		mu.Unlock()
+		return client.WriteMessage(msg)
+	})
+
+	const writers, writes = 8, 200
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := bytes.Repeat([]byte{byte('a' + i)}, 100)
+			for j := 0; j < writes; j++ {
+				_, err := client.Write(msg)
+				if err != nil {
+					t.Errorf("failed to write: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	counts := make(map[byte]int)
+	buf := make([]byte, 100)
+	for i := 0; i < writers*writes; i++ {
+		_, err := io.ReadFull(server, buf)
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		// every write must arrive in one piece
+		if !bytes.Equal(buf, bytes.Repeat(buf[:1], len(buf))) {
+			t.Fatalf("writes were interleaved: %q", buf)
+		}
+		counts[buf[0]]++
+	}
+	wg.Wait()
+
+	for i := 0; i < writers; i++ {
+		if counts[byte('a'+i)] != writes {
+			t.Errorf("expected %v writes from writer %v, got %v", writes, i, counts[byte('a'+i)])
+		}
+	}
+	if reused {
+		t.Errorf("a nonce was reused")
+	}
+	if len(nonces) < writers*writes {
+		t.Errorf("expected at least %v nonces, got %v", writers*writes, len(nonces))
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	client, server := handshakePair(t)
+	defer client.Close()
+	defer server.Close()
+
+	client.Write([]byte("request"))
+	err := client.CloseWrite()
+	if err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if _, err := client.Write([]byte("more")); err != ErrWriteClosed {
+		t.Errorf("expected %v, got %v", ErrWriteClosed, err)
+	}
+
+	bs, err := ioutil.ReadAll(server)
+	if err != nil || string(bs) != "request" {
+		t.Errorf("expected %q, got %q %v", "request", bs, err)
+	}
+
+	// the other direction still works
+	server.Write([]byte("response"))
+	server.Close()
+	bs, err = ioutil.ReadAll(client)
+	if err != nil || string(bs) != "response" {
+		t.Errorf("expected %q, got %q %v", "response", bs, err)
+	}
+}
+
+func TestCloseWriteDeadline(t *testing.T) {
+	client, server := handshakePair(t)
+	defer server.Close()
+
+	// a peer which never reads, so the close record can't be written
+	underlying, stalled := net.Pipe()
+	defer stalled.Close()
+	client.underlying.Close()
+	client.underlying = underlying
+
+	client.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	client.Close()
+	if elapsed := time.Since(start); elapsed > closeTimeout/2 {
+		t.Errorf("expected Close to give up at the write deadline, took %v", elapsed)
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	client, server := handshakePair(t)
+	defer server.Close()
+
+	client.Write([]byte("Hello World"))
+	// cut the connection without closing the session
+	client.underlying.Close()
+
+	buf := make([]byte, 1024)
+	n, err := server.Read(buf)
+	if err != nil || n != 11 {
+		t.Errorf("expected to read %v bytes, read %v: %v", 11, n, err)
+	}
+	_, err = server.Read(buf)
+	if err != ErrTruncated {
+		t.Errorf("expected %v, got %v", ErrTruncated, err)
+	}
+}
+
+func TestPreSharedKey(t *testing.T) {
+	psk := []byte("0123456789abcdef0123456789abcdef")
+	other := []byte("fedcba9876543210fedcba9876543210")
+
+	for _, mode := range []Mode{ModeBox, ModeNoiseXX, ModeNoiseIK} {
+		clientConfig, serverConfig := noiseTestConfigs(mode, NoiseBLAKE2s)
+		clientConfig.PreSharedKey, serverConfig.PreSharedKey = psk, psk
+		client, server := handshakePairConfig(t, clientConfig, serverConfig)
+		go client.Write([]byte("Hello World"))
+		buf := make([]byte, 1024)
+		n, err := server.Read(buf)
+		if err != nil || string(buf[:n]) != "Hello World" {
+			t.Errorf("mode %d: expected %q, got %q %v", mode, "Hello World", buf[:n], err)
+		}
+
+		// the keys depend on the pre-shared key
+		clientConfig.PreSharedKey, serverConfig.PreSharedKey = other, other
+		client2, server2 := handshakePairConfig(t, clientConfig, serverConfig)
+		if client.protocol.sendKey == client2.protocol.sendKey {
+			t.Errorf("mode %d: expected different keys for different pre-shared keys", mode)
+		}
+		client.Close()
+		server.Close()
+		client2.Close()
+		server2.Close()
+
+		for _, keys := range [][2][]byte{{psk, other}, {psk, nil}, {nil, psk}} {
+			clientConfig.PreSharedKey, serverConfig.PreSharedKey = keys[0], keys[1]
+			c1, c2 := tcpPipe(t)
+			errs := make(chan error, 1)
+			go func() {
+				_, err := HandshakeConfig(c2, serverConfig)
+				c2.Close()
+				errs <- err
+			}()
+			_, err := HandshakeConfig(c1, clientConfig)
+			c1.Close()
+			serverErr := <-errs
+			// whoever finds out first fails with ErrPreSharedKeyMismatch,
+			// the other side sees the connection close
+			if err != ErrPreSharedKeyMismatch && serverErr != ErrPreSharedKeyMismatch {
+				t.Errorf("mode %d, keys %q: expected ErrPreSharedKeyMismatch, got %v and %v", mode, keys, err, serverErr)
+			}
+		}
+	}
+}
+
+func TestPreSharedKeyTooShort(t *testing.T) {
+	clientConfig, _ := testConfigs()
+	clientConfig.PreSharedKey = []byte("0123456789abcdef")
+	c1, c2 := tcpPipe(t)
+	defer c1.Close()
+	defer c2.Close()
+	if _, err := HandshakeConfig(c1, clientConfig); err != ErrPreSharedKeyTooShort {
+		t.Errorf("expected %v, got %v", ErrPreSharedKeyTooShort, err)
+	}
+}
+
+func TestHandshakeContext(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+
+	// a peer which never answers
+	c1, c2 := tcpPipe(t)
+	defer c2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := HandshakeContext(ctx, c1, clientConfig); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("expected the handshake to give up at the deadline")
+	}
+	if _, err := c1.Write([]byte("x")); err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+
+	// cancelled halfway
+	c1, c2 = tcpPipe(t)
+	defer c2.Close()
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := HandshakeContext(ctx, c1, clientConfig); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	// a deadline which is met is cleared afterwards
+	c1, c2 = tcpPipe(t)
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	go func() {
+		bc, err := HandshakeConfig(c2, serverConfig)
+		if err == nil {
+			io.Copy(bc, bc)
+		}
+		c2.Close()
+	}()
+	bc, err := HandshakeContext(ctx, c1, clientConfig)
+	if err != nil {
+		t.Fatalf("failed to handshake: %v", err)
+	}
+	defer bc.Close()
+	time.Sleep(300 * time.Millisecond)
+	bc.Write([]byte("Hello World"))
+	bs := make([]byte, 11)
+	if _, err := io.ReadFull(bc, bs); err != nil || string(bs) != "Hello World" {
+		t.Errorf("expected the connection to work after the deadline, got %q %v", bs, err)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	clientConfig, _ := testConfigs()
+
+	// a server which accepts but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := DialContext(ctx, "tcp", l.Addr().String(), clientConfig); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := DialContext(ctx, "tcp", l.Addr().String(), clientConfig); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
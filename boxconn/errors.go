@@ -0,0 +1,118 @@
+package boxconn
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidHandshake is returned when the peer's hello is malformed
+	ErrInvalidHandshake = errors.New("boxconn: invalid handshake")
+	// ErrKeyNotAllowed is returned when the KeyStore doesn't allow the
+	// peer's key. The actual error is a *KeyNotAllowedError, use errors.Is
+	// to check for it.
+	ErrKeyNotAllowed = errors.New("boxconn: key not allowed")
+	// ErrInvalidSessionToken is returned when the peer doesn't echo our
+	// session token back during the handshake
+	ErrInvalidSessionToken = errors.New("boxconn: invalid session token")
+	// ErrInvalidNonce is returned when a message arrives out of order, which
+	// usually means it was replayed or dropped
+	ErrInvalidNonce = errors.New("boxconn: invalid nonce")
+	// ErrDecrypt is returned when a message fails to decrypt, which means it
+	// was corrupted, tampered with or sealed with a different key
+	ErrDecrypt = errors.New("boxconn: error decrypting message")
+	// ErrInvalidRecord is returned when a decrypted message isn't a record
+	// we understand
+	ErrInvalidRecord = errors.New("boxconn: invalid record")
+	// ErrFrameTooLarge is returned when the peer sends a frame larger than
+	// Config.MaxFrameSize. The actual error is a *FrameTooLargeError, use
+	// errors.Is to check for it.
+	ErrFrameTooLarge = errors.New("boxconn: frame too large")
+	// ErrTruncated is returned by Read when the underlying connection ends
+	// without the peer closing the session, which means someone may have
+	// cut it short
+	ErrTruncated = errors.New("boxconn: connection truncated")
+	// ErrWriteClosed is returned by Write after CloseWrite
+	ErrWriteClosed = errors.New("boxconn: write on closed connection")
+	// ErrNoPeerKey is returned when a ModeNoiseIK handshake is initiated
+	// without Config.PeerKey
+	ErrNoPeerKey = errors.New("boxconn: no peer key for noise IK handshake")
+	// ErrInvalidCertificate is returned when the peer's certificate is
+	// malformed, isn't for its key or isn't signed by a trusted authority
+	ErrInvalidCertificate = errors.New("boxconn: invalid certificate")
+	// ErrCertificateExpired is returned when the peer's certificate is not
+	// valid yet or not valid anymore
+	ErrCertificateExpired = errors.New("boxconn: certificate expired")
+	// ErrCertificateHost is returned when the peer's certificate doesn't
+	// list Config.HostName
+	ErrCertificateHost = errors.New("boxconn: certificate not valid for this host")
+	// ErrKeyRevoked is returned when the peer's key is in
+	// Config.Revocations
+	ErrKeyRevoked = errors.New("boxconn: key revoked")
+	// ErrKeyChanged is returned when the server's key doesn't match the one
+	// in Config.KnownHosts. The actual error is a *KeyChangedError, use
+	// errors.Is or errors.As.
+	ErrKeyChanged = errors.New("boxconn: key changed")
+	// ErrPreSharedKeyMismatch is returned when the first message sealed
+	// with the session keys doesn't decrypt, which means the peer uses a
+	// different Config.PreSharedKey, or only one side has one
+	ErrPreSharedKeyMismatch = errors.New("boxconn: pre-shared key mismatch")
+	// ErrPreSharedKeyTooShort is returned when Config.PreSharedKey is set
+	// but shorter than MinPreSharedKeySize
+	ErrPreSharedKeyTooShort = errors.New("boxconn: pre-shared key too short")
+	// ErrBanned is passed to Config.HandshakeFailed when a Listener closes a
+	// connection because its remote IP is banned
+	ErrBanned = errors.New("boxconn: remote address banned")
+	// ErrInvalidProxyHeader is passed to Config.HandshakeFailed when a
+	// connection from one of Config.TrustedProxies doesn't start with a
+	// valid PROXY protocol header
+	ErrInvalidProxyHeader = errors.New("boxconn: invalid proxy protocol header")
+)
+
+// KeyNotAllowedError is returned by the handshake when the KeyStore doesn't
+// allow the peer's key
+type KeyNotAllowedError struct {
+	Key [keySize]byte
+}
+
+func (e *KeyNotAllowedError) Error() string {
+	return fmt.Sprintf("boxconn: key not allowed: %x", e.Key[:])
+}
+
+// Is reports whether target is ErrKeyNotAllowed
+func (e *KeyNotAllowedError) Is(target error) bool {
+	return target == ErrKeyNotAllowed
+}
+
+// KeyChangedError is returned by the handshake when the server at Address
+// has a different key than the one we know
+type KeyChangedError struct {
+	Address    string
+	Known, Key [keySize]byte
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("boxconn: key for %s changed: known key %s, got %s (remove it from the known hosts file if the change is expected)",
+		e.Address, base64.StdEncoding.EncodeToString(e.Known[:]), base64.StdEncoding.EncodeToString(e.Key[:]))
+}
+
+// Is reports whether target is ErrKeyChanged
+func (e *KeyChangedError) Is(target error) bool {
+	return target == ErrKeyChanged
+}
+
+// FrameTooLargeError is returned when the peer sends a frame larger than
+// Config.MaxFrameSize
+type FrameTooLargeError struct {
+	Size, Max uint64
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("boxconn: frame too large: %d > %d", e.Size, e.Max)
+}
+
+// Is reports whether target is ErrFrameTooLarge
+func (e *FrameTooLargeError) Is(target error) bool {
+	return target == ErrFrameTooLarge
+}
@@ -0,0 +1,157 @@
+package boxconn
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// The hello is the first message of the handshake. Version 1 hellos are
+// just our static and ephemeral public keys. Later versions append a magic
+// string, the version, capability flags and a list of extensions, each a
+// type byte, a 16 bit length and the data. Peers which only understand
+// version 1 ignore everything after the keys, so they still interoperate.
+//
+// Both hellos are part of the key derivation, so a peer which tampers with
+// them ends up with different keys and the handshake fails.
+const (
+	helloMagic = "boxc"
+
+	protocolVersion1 = 1
+	protocolVersion2 = 2
+	protocolVersion  = protocolVersion2
+)
+
+// capabilities
+const (
+	// capRekey means the peer understands rekey records
+	capRekey uint32 = 1 << iota
+	// capPadding means the peer understands padded records
+	capPadding
+)
+
+// legacyCapabilities are the capabilities of a version 1 peer
+const legacyCapabilities = capRekey
+
+// hello extension types
+const (
+	extMaxFrameSize byte = iota + 1
+	extCertificate
+)
+
+type hello struct {
+	key, ephemeralKey [keySize]byte
+	version           byte
+	capabilities      uint32
+	// maxFrameSize is the largest frame the sender accepts, zero if it
+	// didn't say
+	maxFrameSize uint32
+	// certificate is the sender's encoded Certificate, if it has one
+	certificate []byte
+}
+
+func (h *hello) marshal() []byte {
+	var buf bytes.Buffer
+	buf.Write(h.key[:])
+	buf.Write(h.ephemeralKey[:])
+	h.writeSettings(&buf)
+	return buf.Bytes()
+}
+
+// writeSettings writes everything after the keys. Noise handshakes carry
+// the keys themselves and only send this part.
+func (h *hello) writeSettings(buf *bytes.Buffer) {
+	if h.version < protocolVersion2 {
+		return
+	}
+
+	buf.WriteString(helloMagic)
+	buf.WriteByte(h.version)
+	binary.Write(buf, binary.BigEndian, h.capabilities)
+
+	if h.maxFrameSize != 0 {
+		var data [4]byte
+		binary.BigEndian.PutUint32(data[:], h.maxFrameSize)
+		writeExtension(buf, extMaxFrameSize, data[:])
+	}
+	if len(h.certificate) > 0 {
+		writeExtension(buf, extCertificate, h.certificate)
+	}
+}
+
+func writeExtension(buf *bytes.Buffer, typ byte, data []byte) {
+	buf.WriteByte(typ)
+	binary.Write(buf, binary.BigEndian, uint16(len(data)))
+	buf.Write(data)
+}
+
+func parseHello(data []byte) (*hello, error) {
+	if len(data) < 2*keySize {
+		return nil, ErrInvalidHandshake
+	}
+	h, err := parseHelloSettings(data[2*keySize:])
+	if err != nil {
+		return nil, err
+	}
+	copy(h.key[:], data[:keySize])
+	copy(h.ephemeralKey[:], data[keySize:2*keySize])
+	return h, nil
+}
+
+// parseHelloSettings parses everything after the keys
+func parseHelloSettings(data []byte) (*hello, error) {
+	h := &hello{
+		version:      protocolVersion1,
+		capabilities: legacyCapabilities,
+	}
+	if len(data) == 0 {
+		return h, nil
+	}
+
+	if len(data) < len(helloMagic)+5 || string(data[:len(helloMagic)]) != helloMagic {
+		return nil, ErrInvalidHandshake
+	}
+	data = data[len(helloMagic):]
+	h.version = data[0]
+	h.capabilities = binary.BigEndian.Uint32(data[1:])
+	data = data[5:]
+	if h.version < protocolVersion2 {
+		return nil, ErrInvalidHandshake
+	}
+
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, ErrInvalidHandshake
+		}
+		typ, length := data[0], int(binary.BigEndian.Uint16(data[1:]))
+		data = data[3:]
+		if len(data) < length {
+			return nil, ErrInvalidHandshake
+		}
+		ext := data[:length]
+		data = data[length:]
+
+		// extensions we don't know about are ignored
+		switch typ {
+		case extMaxFrameSize:
+			if len(ext) != 4 {
+				return nil, ErrInvalidHandshake
+			}
+			h.maxFrameSize = binary.BigEndian.Uint32(ext)
+		case extCertificate:
+			h.certificate = ext
+		}
+	}
+	return h, nil
+}
+
+// negotiate returns the version and capabilities both sides support
+func negotiate(mine, peer *hello) (version byte, capabilities uint32) {
+	version = mine.version
+	if peer.version < version {
+		version = peer.version
+	}
+	if version < protocolVersion2 {
+		return version, legacyCapabilities & mine.capabilities
+	}
+	return version, mine.capabilities & peer.capabilities
+}
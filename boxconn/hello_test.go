@@ -0,0 +1,102 @@
+package boxconn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestHello(t *testing.T) {
+	h := &hello{
+		version:      protocolVersion,
+		capabilities: capRekey | capPadding,
+		maxFrameSize: 4096,
+		certificate:  []byte("certificate"),
+	}
+	h.key[0], h.ephemeralKey[0] = 1, 2
+
+	parsed, err := parseHello(h.marshal())
+	if err != nil {
+		t.Fatalf("failed to parse hello: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, h) {
+		t.Errorf("expected %v, got %v", h, parsed)
+	}
+
+	// unknown extensions are ignored
+	data := append(h.marshal(), 99, 0, 3, 'a', 'b', 'c')
+	if _, err := parseHello(data); err != nil {
+		t.Errorf("expected unknown extensions to be ignored, got %v", err)
+	}
+
+	for _, data := range [][]byte{
+		make([]byte, 2*keySize-1),
+		append(make([]byte, 2*keySize), "not a hello"...),
+		append(h.marshal(), extMaxFrameSize, 0, 2, 1, 2),
+		append(h.marshal(), extMaxFrameSize, 0, 10),
+	} {
+		if _, err := parseHello(data); err != ErrInvalidHandshake {
+			t.Errorf("expected %v for %v, got %v", ErrInvalidHandshake, data, err)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	mine := &hello{version: protocolVersion, capabilities: capRekey | capPadding}
+
+	// a version 1 hello is just the keys
+	legacy, err := parseHello(make([]byte, 2*keySize))
+	if err != nil {
+		t.Fatalf("failed to parse hello: %v", err)
+	}
+	version, capabilities := negotiate(mine, legacy)
+	if version != protocolVersion1 || capabilities != capRekey {
+		t.Errorf("expected version 1 with rekeying, got %v %v", version, capabilities)
+	}
+
+	peer := &hello{version: protocolVersion + 1, capabilities: capPadding | 1<<31}
+	version, capabilities = negotiate(mine, peer)
+	if version != protocolVersion || capabilities != capPadding {
+		t.Errorf("expected version %v with padding, got %v %v", protocolVersion, version, capabilities)
+	}
+}
+
+func TestNegotiatedSettings(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	serverConfig.MaxFrameSize = 2 * MinFrameSize
+	var largest int
+	clientConfig.Tracer = TracerFunc(func(evt Event) {
+		if evt.Type == FrameWritten && evt.Size > largest {
+			largest = evt.Size
+		}
+	})
+
+	client, server := handshakePairConfig(t, clientConfig, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	if client.protocol.version != protocolVersion || client.protocol.capabilities != capRekey|capPadding {
+		t.Errorf("unexpected version %v and capabilities %v", client.protocol.version, client.protocol.capabilities)
+	}
+	if client.protocol.sendFrameSize != 2*MinFrameSize || server.protocol.sendFrameSize != DefaultMaxFrameSize {
+		t.Errorf("expected each side to respect the other's frame size")
+	}
+
+	data := bytes.Repeat([]byte("split me "), 1000)
+	largest = 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.Write(data)
+		client.Close()
+	}()
+	received, err := ioutil.ReadAll(server)
+	if err != nil || !bytes.Equal(received, data) {
+		t.Errorf("expected to receive what was written: %v", err)
+	}
+	<-done
+	if largest+frameHeaderSize > 2*MinFrameSize {
+		t.Errorf("expected frames of at most %v bytes, wrote %v", 2*MinFrameSize, largest+frameHeaderSize)
+	}
+}
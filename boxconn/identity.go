@@ -0,0 +1,70 @@
+package boxconn
+
+import (
+	"encoding/base64"
+	"net"
+)
+
+type (
+	// Identity is the authenticated identity of a peer. It implements
+	// net.Addr so it can be passed around wherever an address is expected.
+	Identity struct {
+		// Key is the peer's long-term public key
+		Key [keySize]byte
+		// Name is the name the KeyStore gave the key, if any
+		Name string
+	}
+)
+
+// Network returns "boxconn"
+func (id Identity) Network() string {
+	return "boxconn"
+}
+
+// String returns the name of the peer, or its base64 encoded key if it
+// doesn't have a name
+func (id Identity) String() string {
+	if id.Name != "" {
+		return id.Name
+	}
+	return base64.StdEncoding.EncodeToString(id.Key[:])
+}
+
+// PeerIdentity returns the identity of the peer on conn. It returns false if
+// conn isn't a boxconn connection.
+func PeerIdentity(conn net.Conn) (Identity, bool) {
+	if c, ok := conn.(*Conn); ok {
+		return c.PeerIdentity(), true
+	}
+	return Identity{}, false
+}
+
+// PeerKey returns the long-term public key of the peer. It is only valid
+// after the handshake.
+func (p *Protocol) PeerKey() [keySize]byte {
+	return p.peerKey
+}
+
+// PeerName returns the name the KeyStore gave the peer's key
+func (p *Protocol) PeerName() string {
+	return p.peerName
+}
+
+// PeerKey returns the long-term public key of the peer
+func (c *Conn) PeerKey() [keySize]byte {
+	return c.protocol.PeerKey()
+}
+
+// PeerName returns the name the KeyStore gave the peer's key. Keys allowed
+// through a KeyList don't have names.
+func (c *Conn) PeerName() string {
+	return c.protocol.PeerName()
+}
+
+// PeerIdentity returns the authenticated identity of the peer
+func (c *Conn) PeerIdentity() Identity {
+	return Identity{
+		Key:  c.PeerKey(),
+		Name: c.PeerName(),
+	}
+}
@@ -0,0 +1,170 @@
+package boxconn
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// A KeyStore decides which peers are allowed to establish a session. It
+	// is consulted during every handshake, so implementations can change
+	// their answer over time.
+	KeyStore interface {
+		// LookupKey returns the name of key and whether it is allowed
+		LookupKey(key [keySize]byte) (name string, ok bool)
+	}
+
+	// KeyList is a KeyStore which allows a fixed list of keys. The keys
+	// don't have names.
+	KeyList [][keySize]byte
+
+	// AuthorizedKey is an entry in an authorized keys file
+	AuthorizedKey struct {
+		Key  [keySize]byte
+		Name string
+		// Expires is the time after which the key is no longer allowed. The
+		// zero value means the key doesn't expire.
+		Expires time.Time
+	}
+
+	// AuthorizedKeys is a KeyStore backed by an authorized keys file. The
+	// file is reloaded whenever it changes. Each line has a base64 encoded
+	// public key, a name and an optional expiry time:
+	//
+	//     # comments start with a #
+	//     8VBo1sPMIoR8VxB2oKgDs4v7tTFXGSpJ1xdn7DdOGR4= alice
+	//     ZmpJkF4ZLjB9Hq7mcSO0Umm8LbSsnjnjlsy8A6dGiTU= bob expires=2016-01-02T15:04:05Z
+	AuthorizedKeys struct {
+		mu   sync.Mutex
+		file watchedFile
+		keys map[[keySize]byte]AuthorizedKey
+	}
+)
+
+// LookupKey returns true if key is in the list
+func (kl KeyList) LookupKey(key [keySize]byte) (string, bool) {
+	for _, k := range kl {
+		if bytes.Equal(k[:], key[:]) {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// LoadAuthorizedKeys reads an authorized keys file. See AuthorizedKeys for
+// the format.
+func LoadAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	ak := &AuthorizedKeys{}
+	ak.file = watchedFile{path: path, parse: ak.parse}
+	err := ak.reload()
+	if err != nil {
+		return nil, err
+	}
+	return ak, nil
+}
+
+// LookupKey returns the name of key and whether it is allowed. Expired keys
+// are not allowed.
+func (ak *AuthorizedKeys) LookupKey(key [keySize]byte) (string, bool) {
+	ak.mu.Lock()
+	defer ak.mu.Unlock()
+
+	// if the file is broken we keep using the keys we already have, if it's
+	// gone we allow nothing
+	err := ak.file.reloadIfChanged()
+	if os.IsNotExist(err) {
+		ak.keys = nil
+	}
+
+	k, ok := ak.keys[key]
+	if !ok {
+		return "", false
+	}
+	if !k.Expires.IsZero() && time.Now().After(k.Expires) {
+		return "", false
+	}
+	return k.Name, true
+}
+
+// Keys returns all the keys in the file
+func (ak *AuthorizedKeys) Keys() []AuthorizedKey {
+	ak.mu.Lock()
+	defer ak.mu.Unlock()
+
+	keys := make([]AuthorizedKey, 0, len(ak.keys))
+	for _, k := range ak.keys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (ak *AuthorizedKeys) reload() error {
+	ak.mu.Lock()
+	defer ak.mu.Unlock()
+
+	return ak.file.reloadIfChanged()
+}
+
+func (ak *AuthorizedKeys) parse(r io.Reader) error {
+	entries, err := ParseAuthorizedKeys(r)
+	if err != nil {
+		return err
+	}
+	keys := make(map[[keySize]byte]AuthorizedKey, len(entries))
+	for _, k := range entries {
+		keys[k.Key] = k
+	}
+	ak.keys = keys
+	return nil
+}
+
+// ParseAuthorizedKeys parses the entries in an authorized keys file
+func ParseAuthorizedKeys(r io.Reader) ([]AuthorizedKey, error) {
+	var keys []AuthorizedKey
+	err := ParseLines(r, func(fields []string) error {
+		var k AuthorizedKey
+		key, err := decodeKey(fields[0])
+		if err != nil {
+			return err
+		}
+		k.Key = key
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "expires=") {
+				k.Expires, err = time.Parse(time.RFC3339, field[len("expires="):])
+				if err != nil {
+					return fmt.Errorf("invalid expiry: %v", err)
+				}
+			} else if k.Name == "" {
+				k.Name = field
+			} else {
+				return fmt.Errorf("unexpected %q", field)
+			}
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// decodeKey decodes a base64 encoded key
+func decodeKey(s string) ([keySize]byte, error) {
+	var key [keySize]byte
+	bs, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return key, fmt.Errorf("invalid key: %v", err)
+	}
+	if len(bs) != keySize {
+		return key, fmt.Errorf("invalid key: expected %d bytes, got %d", keySize, len(bs))
+	}
+	copy(key[:], bs)
+	return key, nil
+}
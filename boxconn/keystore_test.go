@@ -0,0 +1,110 @@
+package boxconn
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/nacl/box"
+)
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	pub1, _, _ := box.GenerateKey(rand.Reader)
+	pub2, _, _ := box.GenerateKey(rand.Reader)
+
+	src := fmt.Sprintf(`# test keys
+%s alice
+  %s bob expires=2015-01-02T15:04:05Z # bob's laptop
+
+`, base64.StdEncoding.EncodeToString(pub1[:]), base64.StdEncoding.EncodeToString(pub2[:]))
+
+	keys, err := ParseAuthorizedKeys(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %v", len(keys))
+	}
+	if keys[0].Key != *pub1 || keys[0].Name != "alice" || !keys[0].Expires.IsZero() {
+		t.Errorf("unexpected first key: %v", keys[0])
+	}
+	expires := time.Date(2015, 1, 2, 15, 4, 5, 0, time.UTC)
+	if keys[1].Key != *pub2 || keys[1].Name != "bob" || !keys[1].Expires.Equal(expires) {
+		t.Errorf("unexpected second key: %v", keys[1])
+	}
+
+	for _, src := range []string{
+		"not-a-key alice",
+		base64.StdEncoding.EncodeToString(pub1[:16]) + " alice",
+		base64.StdEncoding.EncodeToString(pub1[:]) + " alice expires=tomorrow",
+		base64.StdEncoding.EncodeToString(pub1[:]) + " alice bob",
+	} {
+		_, err := ParseAuthorizedKeys(strings.NewReader(src))
+		if err == nil {
+			t.Errorf("expected an error for %q", src)
+		}
+	}
+}
+
+func TestAuthorizedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boxconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "authorized_keys")
+
+	skPub, skPriv, _ := box.GenerateKey(rand.Reader)
+	ckPub, ckPriv, _ := box.GenerateKey(rand.Reader)
+	expiredPub, _, _ := box.GenerateKey(rand.Reader)
+
+	write := func(src string) {
+		err := ioutil.WriteFile(path, []byte(src), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(fmt.Sprintf("%s client\n%s expired expires=2001-01-01T00:00:00Z\n",
+		base64.StdEncoding.EncodeToString(ckPub[:]),
+		base64.StdEncoding.EncodeToString(expiredPub[:])))
+
+	ak, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("failed to load authorized keys: %v", err)
+	}
+	if name, ok := ak.LookupKey(*ckPub); !ok || name != "client" {
+		t.Errorf("expected client key to be allowed, got %q %v", name, ok)
+	}
+	if _, ok := ak.LookupKey(*expiredPub); ok {
+		t.Errorf("expected expired key to be rejected")
+	}
+
+	serverConfig := &Config{PrivateKey: *skPriv, PublicKey: *skPub, KeyStore: ak}
+	clientConfig := &Config{PrivateKey: *ckPriv, PublicKey: *ckPub, KeyStore: KeyList{*skPub}}
+	client, server := handshakePairConfig(t, clientConfig, serverConfig)
+	client.Close()
+	server.Close()
+	if id, ok := PeerIdentity(server); !ok || id.Key != *ckPub || id.Name != "client" {
+		t.Errorf("expected peer identity %q, got %v", "client", id)
+	}
+	if client.PeerKey() != *skPub || client.PeerName() != "" {
+		t.Errorf("expected the server's key without a name, got %v", client.PeerIdentity())
+	}
+
+	// revoke the client
+	write("# nobody\n")
+	if _, ok := ak.LookupKey(*ckPub); ok {
+		t.Errorf("expected client key to be revoked")
+	}
+
+	os.Remove(path)
+	if _, ok := ak.LookupKey(*ckPub); ok {
+		t.Errorf("expected no keys to be allowed without a file")
+	}
+}
@@ -0,0 +1,165 @@
+package boxconn
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+type (
+	// KnownHosts remembers the key of every server we've connected to,
+	// like SSH's known_hosts file. The first time we connect to an address
+	// its key is added to the file once the handshake succeeds, after that
+	// any other key is rejected with a *KeyChangedError. Each line has the
+	// address as it was dialed and the base64 encoded public key:
+	//
+	//     # comments start with a #
+	//     example.com:5000 8VBo1sPMIoR8VxB2oKgDs4v7tTFXGSpJ1xdn7DdOGR4=
+	//
+	// The file is reloaded whenever it changes, so a changed key can be
+	// accepted by removing its line.
+	KnownHosts struct {
+		mu   sync.Mutex
+		file watchedFile
+		keys map[string][keySize]byte
+	}
+
+	// KnownHost is an entry in a known hosts file
+	KnownHost struct {
+		Address string
+		Key     [keySize]byte
+	}
+)
+
+// LoadKnownHosts reads a known hosts file. A missing file is treated as an
+// empty one and created when the first key is added.
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	kh := &KnownHosts{}
+	kh.file = watchedFile{path: path, parse: kh.parse}
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	err := kh.reloadIfChanged()
+	if err != nil {
+		return nil, err
+	}
+	return kh, nil
+}
+
+// Lookup returns the known key for address
+func (kh *KnownHosts) Lookup(address string) ([keySize]byte, bool, error) {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	err := kh.reloadIfChanged()
+	if err != nil {
+		return zeroKey, false, err
+	}
+	key, ok := kh.keys[address]
+	return key, ok, nil
+}
+
+// Add adds key as the known key for address. If we already know a
+// different key a *KeyChangedError is returned.
+func (kh *KnownHosts) Add(address string, key [keySize]byte) error {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	err := kh.reloadIfChanged()
+	if err != nil {
+		return err
+	}
+	if known, ok := kh.keys[address]; ok {
+		if known != key {
+			return &KeyChangedError{Address: address, Known: known, Key: key}
+		}
+		return nil
+	}
+	return kh.add(address, key)
+}
+
+// Hosts returns all the entries in the file
+func (kh *KnownHosts) Hosts() []KnownHost {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	hosts := make([]KnownHost, 0, len(kh.keys))
+	for address, key := range kh.keys {
+		hosts = append(hosts, KnownHost{address, key})
+	}
+	return hosts
+}
+
+func (kh *KnownHosts) add(address string, key [keySize]byte) error {
+	if address == "" || strings.ContainsAny(address, " \t\n#") {
+		return fmt.Errorf("boxconn: invalid known host address %q", address)
+	}
+	f, err := os.OpenFile(kh.file.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%s %s\n", address, base64.StdEncoding.EncodeToString(key[:]))
+	// someone may have edited the file and left off the last newline
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+			line = "\n" + line
+		}
+	}
+	_, err = io.WriteString(f, line)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	kh.keys[address] = key
+	// the file changed under us, make sure we read it again next time
+	kh.file.invalidate()
+	return nil
+}
+
+func (kh *KnownHosts) reloadIfChanged() error {
+	err := kh.file.reloadIfChanged()
+	if os.IsNotExist(err) {
+		kh.keys = make(map[string][keySize]byte)
+		return nil
+	}
+	return err
+}
+
+func (kh *KnownHosts) parse(r io.Reader) error {
+	entries, err := ParseKnownHosts(r)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string][keySize]byte, len(entries))
+	for _, h := range entries {
+		keys[h.Address] = h.Key
+	}
+	kh.keys = keys
+	return nil
+}
+
+// ParseKnownHosts parses the entries in a known hosts file
+func ParseKnownHosts(r io.Reader) ([]KnownHost, error) {
+	var hosts []KnownHost
+	err := ParseLines(r, func(fields []string) error {
+		if len(fields) != 2 {
+			return fmt.Errorf("expected an address and a key")
+		}
+		key, err := decodeKey(fields[1])
+		if err != nil {
+			return err
+		}
+		hosts = append(hosts, KnownHost{fields[0], key})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
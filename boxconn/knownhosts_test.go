@@ -0,0 +1,158 @@
+package boxconn
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.crypto/nacl/box"
+)
+
+func TestParseKnownHosts(t *testing.T) {
+	hosts, err := ParseKnownHosts(strings.NewReader(`# test hosts
+example.com:5000 8VBo1sPMIoR8VxB2oKgDs4v7tTFXGSpJ1xdn7DdOGR4=
+
+  [::1]:5000 ZmpJkF4ZLjB9Hq7mcSO0Umm8LbSsnjnjlsy8A6dGiTU= # localhost
+`))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if len(hosts) != 2 || hosts[0].Address != "example.com:5000" || hosts[1].Address != "[::1]:5000" {
+		t.Fatalf("unexpected hosts: %v", hosts)
+	}
+
+	for _, src := range []string{
+		"example.com:5000",
+		"example.com:5000 not-a-key",
+		"example.com:5000 8VBo1sPMIoR8VxB2oKgDs4v7tTFXGSpJ1xdn7DdOGR4= extra",
+	} {
+		if _, err := ParseKnownHosts(strings.NewReader(src)); err == nil {
+			t.Errorf("expected an error for %q", src)
+		}
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boxconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_hosts")
+
+	kh, err := LoadKnownHosts(path)
+	if err != nil {
+		t.Fatalf("failed to load known hosts: %v", err)
+	}
+
+	clientConfig, serverConfig := testConfigs()
+	clientConfig.KeyStore = nil
+	clientConfig.KnownHosts = kh
+
+	// the first time the key is remembered
+	l, err := ListenConfig("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := DialConfig("tcp", l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatalf("expected an unknown host to be allowed, got %v", err)
+	}
+	if c.PeerName() != l.Addr().String() {
+		t.Errorf("expected the peer to be named %v, got %q", l.Addr(), c.PeerName())
+	}
+	c.Close()
+
+	hosts := kh.Hosts()
+	if len(hosts) != 1 || hosts[0].Address != l.Addr().String() || hosts[0].Key != serverConfig.PublicKey {
+		t.Fatalf("expected the server's key to be remembered, got %v", hosts)
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected the known hosts file to be created with mode 0600, got %v %v", fi, err)
+	}
+
+	// the file is read back
+	kh, err = LoadKnownHosts(path)
+	if err != nil {
+		t.Fatalf("failed to reload known hosts: %v", err)
+	}
+	if key, ok, _ := kh.Lookup(l.Addr().String()); !ok || key != serverConfig.PublicKey {
+		t.Fatalf("expected %v to be known", l.Addr())
+	}
+	clientConfig.KnownHosts = kh
+
+	handshakeAt := func(address string, serverConfig *Config) error {
+		c1, c2 := tcpPipe(t)
+		defer c1.Close()
+		defer c2.Close()
+		go func() {
+			HandshakeConfig(c2, serverConfig)
+			c2.Close()
+		}()
+		_, err := handshake(c1, clientConfig, address)
+		return err
+	}
+
+	// the same server again
+	if err := handshakeAt(l.Addr().String(), serverConfig); err != nil {
+		t.Fatalf("expected a known host to be allowed, got %v", err)
+	}
+
+	// a different server at the same address
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	otherServer := newConfig(*priv, *pub, [][keySize]byte{clientConfig.PublicKey})
+	err = handshakeAt(l.Addr().String(), otherServer)
+	var changed *KeyChangedError
+	if !errors.Is(err, ErrKeyChanged) || !errors.As(err, &changed) {
+		t.Fatalf("expected ErrKeyChanged, got %v", err)
+	}
+	if changed.Known != serverConfig.PublicKey || changed.Key != *pub || changed.Address != l.Addr().String() {
+		t.Errorf("unexpected error details: %v", changed)
+	}
+	if len(kh.Hosts()) != 1 {
+		t.Errorf("expected the changed key not to be remembered, got %v", kh.Hosts())
+	}
+}
+
+func TestKnownHostsMissingNewline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boxconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_hosts")
+
+	// edited by hand, without a newline at the end
+	err = ioutil.WriteFile(path, []byte("example.com:5000 8VBo1sPMIoR8VxB2oKgDs4v7tTFXGSpJ1xdn7DdOGR4="), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, err := LoadKnownHosts(path)
+	if err != nil {
+		t.Fatalf("failed to load known hosts: %v", err)
+	}
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	if err := kh.Add("example.org:5000", *pub); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+
+	kh, err = LoadKnownHosts(path)
+	if err != nil {
+		t.Fatalf("failed to reload known hosts: %v", err)
+	}
+	if hosts := kh.Hosts(); len(hosts) != 2 {
+		t.Errorf("expected both hosts, got %v", hosts)
+	}
+}
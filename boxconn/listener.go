@@ -1,14 +1,32 @@
 package boxconn
 
 import (
+	"errors"
 	"net"
+	"sync"
+	"time"
 )
 
+var errClosing = errors.New("use of closed network connection")
+
 type (
+	// Listener accepts connections and establishes sessions on them. Handshakes
+	// run in the background, so a slow client doesn't hold up anyone else.
+	// Remote IPs whose handshakes keep failing are banned for a while, see
+	// Config.MaxHandshakeFailures. Behind a load balancer the client address
+	// can be taken from a PROXY protocol header, see Config.TrustedProxies.
 	Listener struct {
-		underlying            net.Listener
-		privateKey, publicKey [32]byte
-		allowedKeys           [][32]byte
+		underlying net.Listener
+		config     *Config
+		throttle   *throttle
+
+		pending chan struct{}
+		conns   chan *Conn
+		done    chan struct{}
+		err     error
+
+		closed    chan struct{}
+		closeOnce sync.Once
 	}
 )
 
@@ -18,36 +36,162 @@ func Listen(network, laddr string, privateKey, publicKey [32]byte, allowedKeys .
 	if err != nil {
 		return nil, err
 	}
-	return &Listener{
-		underlying:  underlying,
-		privateKey:  privateKey,
-		publicKey:   publicKey,
-		allowedKeys: allowedKeys,
-	}, nil
+	return NewListener(underlying, newConfig(privateKey, publicKey, allowedKeys)), nil
 }
 
-// Accept waits for and returns the next connection to the listener.
-func (l *Listener) Accept() (net.Conn, error) {
+// ListenConfig is like Listen but takes its keys and settings from config
+func ListenConfig(network, laddr string, config *Config) (*Listener, error) {
+	underlying, err := net.Listen(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(underlying, config), nil
+}
+
+// NewListener wraps an existing listener. Connections returned by Accept
+// are established using config, as the responder of a Noise handshake.
+func NewListener(underlying net.Listener, config *Config) *Listener {
+	config = config.withInitiator(false)
+	l := &Listener{
+		underlying: underlying,
+		config:     config,
+		throttle:   newThrottle(config),
+		pending:    make(chan struct{}, config.maxPendingHandshakes()),
+		conns:      make(chan *Conn),
+		done:       make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+// serve accepts connections from the underlying listener and starts a
+// handshake for each of them
+func (l *Listener) serve() {
+	defer close(l.done)
+
+	var delay time.Duration
 	for {
+		// wait for a free handshake slot
+		select {
+		case l.pending <- struct{}{}:
+		case <-l.closed:
+			l.err = errClosing
+			return
+		}
+
 		conn, err := l.underlying.Accept()
 		if err != nil {
-			return nil, err
+			<-l.pending
+			// back off on temporary errors (like running out of file
+			// descriptors), just like net/http does
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			l.err = err
+			return
 		}
+		delay = 0
 
-		boxconn, err := Handshake(conn, l.privateKey, l.publicKey, l.allowedKeys...)
-		// if the handshake fails, we skip close the connection and skip it
+		go l.handshake(conn)
+	}
+}
+
+// handshake establishes a session on conn and hands it to Accept
+func (l *Listener) handshake(conn net.Conn) {
+	defer func() { <-l.pending }()
+
+	timeout := l.config.handshakeTimeout()
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	// connections from a load balancer tell us who the client is. A bad
+	// header is the balancer's fault, so it doesn't count against it.
+	// Without a client address, for example the balancer's own health
+	// checks, we get conn back and the handshake is with the balancer.
+	if l.config.trustsProxy(conn.RemoteAddr()) {
+		pc, err := readProxyHeader(conn)
 		if err != nil {
 			conn.Close()
-			continue
+			l.handshakeFailed(conn.RemoteAddr(), err)
+			return
+		}
+		conn = pc
+	}
+
+	ip := remoteIP(conn.RemoteAddr())
+	// banning a balancer would ban every client behind it
+	throttled := !l.config.trustsProxy(conn.RemoteAddr())
+	if throttled && l.throttle.banned(ip, time.Now()) {
+		conn.Close()
+		l.handshakeFailed(conn.RemoteAddr(), ErrBanned)
+		return
+	}
+	// clients are never known hosts
+	bc, err := handshake(conn, l.config, "")
+	if err == nil && timeout > 0 {
+		err = conn.SetDeadline(time.Time{})
+	}
+	// if the handshake fails, we close the connection and skip it
+	if err != nil {
+		conn.Close()
+		if throttled {
+			l.throttle.fail(ip, time.Now())
 		}
+		l.handshakeFailed(conn.RemoteAddr(), err)
+		return
+	}
+	if throttled {
+		l.throttle.succeed(ip)
+	}
+
+	select {
+	case l.conns <- bc:
+	case <-l.closed:
+		bc.Close()
+	}
+}
+
+func (l *Listener) handshakeFailed(addr net.Addr, err error) {
+	if l.config.HandshakeFailed != nil {
+		l.config.HandshakeFailed(addr, err)
+	}
+}
 
-		return boxconn, nil
+// Bans returns the remote IPs which are currently banned
+func (l *Listener) Bans() []Ban {
+	return l.throttle.bans(time.Now())
+}
+
+// Unban lifts the ban on a remote IP and forgets its failed handshakes
+func (l *Listener) Unban(ip string) {
+	l.throttle.unban(ip)
+}
+
+// Accept waits for and returns the next connection to the listener. Only
+// connections which completed their handshake are returned.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case bc := <-l.conns:
+		return bc, nil
+	case <-l.done:
+		return nil, l.err
 	}
 }
 
 // Close closes the listener.
 // Any blocked Accept operations will be unblocked and return errors.
 func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
 	return l.underlying.Close()
 }
 
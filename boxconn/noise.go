@@ -0,0 +1,504 @@
+package boxconn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"hash"
+	"io"
+	"time"
+)
+
+// This file implements the parts of the Noise Protocol Framework
+// (https://noiseprotocol.org/noise.html, revision 34) we need: the XX and
+// IK patterns with Curve25519, ChaChaPoly and either BLAKE2s or SHA256. The
+// names follow the specification. Pre-shared keys are our own addition, not
+// the specification's psk modifier, see mixPreSharedKey.
+
+// noisePrologue is mixed into every boxconn Noise handshake, so a Noise
+// handshake meant for something else can't be used against us
+const noisePrologue = "boxconn"
+
+// noise tokens
+const (
+	tokenE byte = iota
+	tokenS
+	tokenEE
+	tokenES
+	tokenSE
+	tokenSS
+)
+
+type noisePattern struct {
+	name string
+	// responderPreMessage means the initiator knows the responder's static
+	// key before the handshake (<- s)
+	responderPreMessage bool
+	messages            [][]byte
+}
+
+var (
+	noiseXX = noisePattern{
+		name: "XX",
+		messages: [][]byte{
+			{tokenE},
+			{tokenE, tokenEE, tokenS, tokenES},
+			{tokenS, tokenSE},
+		},
+	}
+	noiseIK = noisePattern{
+		name:                "IK",
+		responderPreMessage: true,
+		messages: [][]byte{
+			{tokenE, tokenES, tokenS, tokenSS},
+			{tokenE, tokenEE, tokenSE},
+		},
+	}
+)
+
+// noiseCipherState is the CipherState object: a ChaChaPoly key and the
+// counter used as its nonce
+type noiseCipherState struct {
+	k      [keySize]byte
+	hasKey bool
+	n      uint64
+}
+
+func (cs *noiseCipherState) initializeKey(key []byte) {
+	copy(cs.k[:], key)
+	cs.hasKey = true
+	cs.n = 0
+}
+
+func (cs *noiseCipherState) encryptWithAd(ad, plaintext []byte) []byte {
+	if !cs.hasKey {
+		return append([]byte(nil), plaintext...)
+	}
+	ciphertext := noiseEncrypt(&cs.k, cs.n, ad, plaintext)
+	cs.n++
+	return ciphertext
+}
+
+func (cs *noiseCipherState) decryptWithAd(ad, ciphertext []byte) ([]byte, error) {
+	if !cs.hasKey {
+		return append([]byte(nil), ciphertext...), nil
+	}
+	plaintext, err := noiseDecrypt(&cs.k, cs.n, ad, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	cs.n++
+	return plaintext, nil
+}
+
+// noiseNonce encodes n the way the ChaChaPoly cipher functions do: 32
+// bits of zeros followed by the little-endian counter
+func noiseNonce(n uint64) []byte {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+	return nonce[:]
+}
+
+func noiseEncrypt(k *[keySize]byte, n uint64, ad, plaintext []byte) []byte {
+	aead, _ := chacha20poly1305.New(k[:])
+	return aead.Seal(nil, noiseNonce(n), plaintext, ad)
+}
+
+func noiseDecrypt(k *[keySize]byte, n uint64, ad, ciphertext []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(k[:])
+	plaintext, err := aead.Open(nil, noiseNonce(n), ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// noiseRekey replaces k with the first 32 bytes of the encryption of 32
+// zeros under the maximum nonce
+func noiseRekey(k *[keySize]byte) {
+	var zeros [keySize]byte
+	copy(k[:], noiseEncrypt(k, ^uint64(0), nil, zeros[:]))
+}
+
+// noiseSymmetricState is the SymmetricState object
+type noiseSymmetricState struct {
+	cs    noiseCipherState
+	hash  func() hash.Hash
+	ck, h []byte
+}
+
+func newNoiseSymmetricState(protocolName string, hashFunc func() hash.Hash) *noiseSymmetricState {
+	ss := &noiseSymmetricState{hash: hashFunc}
+	size := hashFunc().Size()
+	if len(protocolName) <= size {
+		ss.h = make([]byte, size)
+		copy(ss.h, protocolName)
+	} else {
+		ss.h = ss.sum([]byte(protocolName))
+	}
+	ss.ck = append([]byte(nil), ss.h...)
+	return ss
+}
+
+func (ss *noiseSymmetricState) sum(data ...[]byte) []byte {
+	h := ss.hash()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func (ss *noiseSymmetricState) hmac(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(ss.hash, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// hkdf is the two output HKDF from the specification
+func (ss *noiseSymmetricState) hkdf(ikm []byte) (out1, out2 []byte) {
+	tempKey := ss.hmac(ss.ck, ikm)
+	out1 = ss.hmac(tempKey, []byte{1})
+	out2 = ss.hmac(tempKey, out1, []byte{2})
+	return out1, out2
+}
+
+func (ss *noiseSymmetricState) mixKey(ikm []byte) {
+	ck, tempKey := ss.hkdf(ikm)
+	ss.ck = ck
+	ss.cs.initializeKey(tempKey[:keySize])
+}
+
+func (ss *noiseSymmetricState) mixHash(data []byte) {
+	ss.h = ss.sum(ss.h, data)
+}
+
+func (ss *noiseSymmetricState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := ss.cs.encryptWithAd(ss.h, plaintext)
+	ss.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (ss *noiseSymmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := ss.cs.decryptWithAd(ss.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the keys for initiator to responder and responder to
+// initiator messages
+func (ss *noiseSymmetricState) split() (c1, c2 [keySize]byte) {
+	k1, k2 := ss.hkdf(nil)
+	copy(c1[:], k1)
+	copy(c2[:], k2)
+	return c1, c2
+}
+
+// noiseHandshakeState is the HandshakeState object
+type noiseHandshakeState struct {
+	ss        *noiseSymmetricState
+	pattern   noisePattern
+	initiator bool
+
+	s, e       noiseKeyPair
+	rs, re     [keySize]byte
+	hasRemoteS bool
+	// psk is Config.PreSharedKey, see mixPreSharedKey
+	psk []byte
+
+	message int
+}
+
+type noiseKeyPair struct {
+	private, public [keySize]byte
+}
+
+// newNoiseHandshakeState initializes a handshake. The ephemeral key is
+// generated right away from rand, so it can be used before it is sent.
+func newNoiseHandshakeState(pattern noisePattern, hashFunc func() hash.Hash, hashName string, initiator bool, prologue []byte, s noiseKeyPair, rs *[keySize]byte, rand io.Reader) (*noiseHandshakeState, error) {
+	hs := &noiseHandshakeState{
+		ss:        newNoiseSymmetricState("Noise_"+pattern.name+"_25519_ChaChaPoly_"+hashName, hashFunc),
+		pattern:   pattern,
+		initiator: initiator,
+		s:         s,
+	}
+	if _, err := io.ReadFull(rand, hs.e.private[:]); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(hs.e.private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(hs.e.public[:], public)
+
+	if rs != nil {
+		hs.rs, hs.hasRemoteS = *rs, true
+	}
+	hs.ss.mixHash(prologue)
+	if pattern.responderPreMessage {
+		if initiator {
+			hs.ss.mixHash(hs.rs[:])
+		} else {
+			hs.ss.mixHash(hs.s.public[:])
+		}
+	}
+	return hs, nil
+}
+
+// myTurn returns true if the next handshake message is ours to write
+func (hs *noiseHandshakeState) myTurn() bool {
+	return (hs.message%2 == 0) == hs.initiator
+}
+
+// finished returns true once all the handshake messages have been sent
+func (hs *noiseHandshakeState) finished() bool {
+	return hs.message >= len(hs.pattern.messages)
+}
+
+func (hs *noiseHandshakeState) dh(private, public *[keySize]byte) ([]byte, error) {
+	shared, err := curve25519.X25519(private[:], public[:])
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	return shared, nil
+}
+
+// mixDH performs the DH for a ee, es, se or ss token and mixes the result
+// into the key
+func (hs *noiseHandshakeState) mixDH(token byte) error {
+	var private, public *[keySize]byte
+	switch token {
+	case tokenEE:
+		private, public = &hs.e.private, &hs.re
+	case tokenSS:
+		private, public = &hs.s.private, &hs.rs
+	case tokenES:
+		if hs.initiator {
+			private, public = &hs.e.private, &hs.rs
+		} else {
+			private, public = &hs.s.private, &hs.re
+		}
+	case tokenSE:
+		if hs.initiator {
+			private, public = &hs.s.private, &hs.re
+		} else {
+			private, public = &hs.e.private, &hs.rs
+		}
+	}
+	shared, err := hs.dh(private, public)
+	if err != nil {
+		return err
+	}
+	hs.ss.mixKey(shared)
+	clearBytes(shared)
+	return nil
+}
+
+func (hs *noiseHandshakeState) writeMessage(payload []byte) ([]byte, error) {
+	var msg []byte
+	for _, token := range hs.pattern.messages[hs.message] {
+		switch token {
+		case tokenE:
+			msg = append(msg, hs.e.public[:]...)
+			hs.ss.mixHash(hs.e.public[:])
+		case tokenS:
+			msg = append(msg, hs.ss.encryptAndHash(hs.s.public[:])...)
+		default:
+			if err := hs.mixDH(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+	hs.mixPreSharedKey()
+	msg = append(msg, hs.ss.encryptAndHash(payload)...)
+	hs.message++
+	return msg, nil
+}
+
+func (hs *noiseHandshakeState) readMessage(msg []byte) ([]byte, error) {
+	for _, token := range hs.pattern.messages[hs.message] {
+		switch token {
+		case tokenE:
+			if len(msg) < keySize {
+				return nil, ErrInvalidHandshake
+			}
+			copy(hs.re[:], msg[:keySize])
+			hs.ss.mixHash(hs.re[:])
+			msg = msg[keySize:]
+		case tokenS:
+			size := keySize
+			if hs.ss.cs.hasKey {
+				size += chacha20poly1305.Overhead
+			}
+			if len(msg) < size {
+				return nil, ErrInvalidHandshake
+			}
+			rs, err := hs.ss.decryptAndHash(msg[:size])
+			if err != nil {
+				return nil, ErrInvalidHandshake
+			}
+			copy(hs.rs[:], rs)
+			hs.hasRemoteS = true
+			msg = msg[size:]
+		default:
+			if err := hs.mixDH(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+	last := hs.mixPreSharedKey()
+	payload, err := hs.ss.decryptAndHash(msg)
+	if err != nil {
+		// everything else in the message checked out, so the keys
+		// only differ if the pre-shared keys do
+		if last {
+			return nil, ErrPreSharedKeyMismatch
+		}
+		return nil, ErrInvalidHandshake
+	}
+	hs.message++
+	return payload, nil
+}
+
+// mixPreSharedKey mixes the pre-shared key into the chaining key before the
+// payload of the last message, and returns true if this is the last
+// message. Failing to decrypt that payload is the key confirmation. This
+// isn't the psk modifier from the specification, so with a pre-shared key
+// the handshake no longer interoperates with other Noise implementations.
+func (hs *noiseHandshakeState) mixPreSharedKey() bool {
+	if hs.message != len(hs.pattern.messages)-1 {
+		return false
+	}
+	if len(hs.psk) > 0 {
+		hs.ss.mixKey(hs.psk)
+	}
+	return true
+}
+
+// transportKeys returns our send and receive keys once the handshake is
+// finished
+func (hs *noiseHandshakeState) transportKeys() (sendKey, recvKey [keySize]byte) {
+	c1, c2 := hs.ss.split()
+	if hs.initiator {
+		return c1, c2
+	}
+	return c2, c1
+}
+
+func (hs *noiseHandshakeState) clear() {
+	clearKey(&hs.e.private)
+	clearKey(&hs.ss.cs.k)
+	clearBytes(hs.ss.ck)
+}
+
+func newBLAKE2s() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+func noiseHashFunc(h NoiseHash) (func() hash.Hash, string) {
+	if h == NoiseSHA256 {
+		return sha256.New, "SHA256"
+	}
+	return newBLAKE2s, "BLAKE2s"
+}
+
+// noiseHandshake establishes a session using a Noise pattern instead of the
+// boxconn handshake. Our hello settings travel as the payload of the last
+// handshake message we write, which is always encrypted.
+func (p *Protocol) noiseHandshake(config *Config) error {
+	pattern := noiseXX
+	if config.Mode == ModeNoiseIK {
+		pattern = noiseIK
+	}
+	var rs *[keySize]byte
+	if pattern.responderPreMessage && config.Initiator {
+		if config.PeerKey == zeroKey {
+			return ErrNoPeerKey
+		}
+		rs = &config.PeerKey
+	}
+	p.privateKey, p.publicKey = config.PrivateKey, config.PublicKey
+
+	hashFunc, hashName := noiseHashFunc(config.NoiseHash)
+	s := noiseKeyPair{private: config.PrivateKey, public: config.PublicKey}
+	hs, err := newNoiseHandshakeState(pattern, hashFunc, hashName, config.Initiator, []byte(noisePrologue), s, rs, crand.Reader)
+	if err != nil {
+		return err
+	}
+	hs.psk = config.PreSharedKey
+	defer hs.clear()
+
+	myHello := localHello(config, &hs.e.public)
+	myHello.key = config.PublicKey
+	var settings bytes.Buffer
+	myHello.writeSettings(&settings)
+
+	var peerHello *hello
+	authorized := false
+	for {
+		// check the peer's key as soon as we know it, so we don't tell an
+		// unknown peer who we are
+		if hs.hasRemoteS && !authorized {
+			p.peerKey = hs.rs
+			err := p.authorize(config, hs.rs, peerHello)
+			if err != nil {
+				return err
+			}
+			authorized = true
+		}
+		if hs.finished() {
+			break
+		}
+
+		last := hs.message+2 >= len(pattern.messages)
+		if hs.myTurn() {
+			var payload []byte
+			if last {
+				payload = settings.Bytes()
+			}
+			msg, err := hs.writeMessage(payload)
+			if err != nil {
+				return err
+			}
+			err = p.WriteRaw(msg)
+			if err != nil {
+				return err
+			}
+		} else {
+			msg, err := p.ReadRaw()
+			if err != nil {
+				return err
+			}
+			payload, err := hs.readMessage(msg)
+			if err != nil {
+				return err
+			}
+			if last {
+				peerHello, err = parseHelloSettings(payload)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	err = p.agree(config, myHello, peerHello)
+	if err != nil {
+		return err
+	}
+	p.sendKey, p.recvKey = hs.transportKeys()
+	p.noise = true
+	p.sendKeyCreated = time.Now()
+	p.setEstablished()
+	return nil
+}
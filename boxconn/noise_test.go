@@ -0,0 +1,439 @@
+package boxconn
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/crypto/curve25519"
+	"io/ioutil"
+	"testing"
+)
+
+// noiseVectors are every Noise_XX and Noise_IK vector with the cipher and
+// hashes we support from vectors.txt in github.com/flynn/noise v1.1.0,
+// generated by cacophony. They use the static and ephemeral keys in
+// TestNoiseVectors, with and without a prologue and handshake payloads. The
+// payloads and ciphertexts are hex encoded.
+var noiseVectors = []struct {
+	name     string
+	pattern  noisePattern
+	hash     NoiseHash
+	prologue string
+	messages []noiseVectorMessage
+}{
+	{
+		name:     "Noise_XX_25519_ChaChaPoly_BLAKE2s",
+		pattern:  noiseXX,
+		hash:     NoiseBLAKE2s,
+		prologue: "",
+		messages: []noiseVectorMessage{
+			{"", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254"},
+			{"", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466c7f9c130891d2fcc2454ad9808ce708c7fde0ef21e72e985c38a6ed8cdaadcd96586759f804d4fa61b89ea5b36cb9b3eb1eab4273f15b629e3508d6f11a78c6d"},
+			{"", "e42e3908de4cd096b8b86320dfe9d03127451fdbfc423fd9ef86b4659fae03c86a279a2a864a1429147865a5dba40deed136252f2229fc5c4bcd2d5ec2efbfc2"},
+			{"79656c6c6f777375626d6172696e65", "7086fc0466ee7523680d09ff7c272e2a2817a6e2d6c4ec1c209506506e8957"},
+			{"7375626d6172696e6579656c6c6f77", "e3beadf28ea871a3be666f43eaf457d030e538eb371ba48076a7db36a9a1bf"},
+		},
+	},
+	{
+		name:     "Noise_XX_25519_ChaChaPoly_BLAKE2s",
+		pattern:  noiseXX,
+		hash:     NoiseBLAKE2s,
+		prologue: "",
+		messages: []noiseVectorMessage{
+			{"746573745f6d73675f30", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254746573745f6d73675f30"},
+			{"746573745f6d73675f31", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466c7f9c130891d2fcc2454ad9808ce708c7fde0ef21e72e985c38a6ed8cdaadcd9c0e3ed9de7ec29f5c2988dab99fc75b461f5532ce998f718c56fe4ae560e9b71afacf18e82fbda729ee6"},
+			{"746573745f6d73675f32", "e42e3908de4cd096b8b86320dfe9d03127451fdbfc423fd9ef86b4659fae03c8498dfa777a39cf59d06c8cf8230f924bf6cfb3372d0d7f9f5da0a2795066e1e7f5b7bc545578661f6731"},
+			{"79656c6c6f777375626d6172696e65", "7086fc0466ee7523680d09ff7c272e2a2817a6e2d6c4ec1c209506506e8957"},
+			{"7375626d6172696e6579656c6c6f77", "e3beadf28ea871a3be666f43eaf457d030e538eb371ba48076a7db36a9a1bf"},
+		},
+	},
+	{
+		name:     "Noise_XX_25519_ChaChaPoly_BLAKE2s",
+		pattern:  noiseXX,
+		hash:     NoiseBLAKE2s,
+		prologue: "6e6f74736563726574",
+		messages: []noiseVectorMessage{
+			{"", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254"},
+			{"", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466c7f9c130891d2fcc2454ad9808ce708c7fde0ef21e72e985c38a6ed8cdaadcd95d49ccad379691a89b57368d70add1bd30d7757d21b91f1b9981ac3f6cc36f79"},
+			{"", "e42e3908de4cd096b8b86320dfe9d03127451fdbfc423fd9ef86b4659fae03c8e7b0c7c5612fc71db82f4f8ab985fab34ef5d36e101b730d9ff6de037479f032"},
+			{"79656c6c6f777375626d6172696e65", "7086fc0466ee7523680d09ff7c272e2a2817a6e2d6c4ec1c209506506e8957"},
+			{"7375626d6172696e6579656c6c6f77", "e3beadf28ea871a3be666f43eaf457d030e538eb371ba48076a7db36a9a1bf"},
+		},
+	},
+	{
+		name:     "Noise_XX_25519_ChaChaPoly_BLAKE2s",
+		pattern:  noiseXX,
+		hash:     NoiseBLAKE2s,
+		prologue: "6e6f74736563726574",
+		messages: []noiseVectorMessage{
+			{"746573745f6d73675f30", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254746573745f6d73675f30"},
+			{"746573745f6d73675f31", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466c7f9c130891d2fcc2454ad9808ce708c7fde0ef21e72e985c38a6ed8cdaadcd9e07ed4c7d77e83b721e41d9bb2a8b57761f5532ce998f718c56f18083ab9e2f47c3f7f545a5eabbc4ece"},
+			{"746573745f6d73675f32", "e42e3908de4cd096b8b86320dfe9d03127451fdbfc423fd9ef86b4659fae03c897f77a2af21f5ce18cde8740fe9e5912f6cfb3372d0d7f9f5da0d9be88017bb339b951c56929f77fe9d6"},
+			{"79656c6c6f777375626d6172696e65", "7086fc0466ee7523680d09ff7c272e2a2817a6e2d6c4ec1c209506506e8957"},
+			{"7375626d6172696e6579656c6c6f77", "e3beadf28ea871a3be666f43eaf457d030e538eb371ba48076a7db36a9a1bf"},
+		},
+	},
+	{
+		name:     "Noise_IK_25519_ChaChaPoly_BLAKE2s",
+		pattern:  noiseIK,
+		hash:     NoiseBLAKE2s,
+		prologue: "",
+		messages: []noiseVectorMessage{
+			{"", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254c9f0dff42c86abe5677abe74f6c87301577dbc1f3ffb2213827ca694a057fdbbff7f7350265fe61102c24d7d7a7e960ba8b90a679895087c7d28b1d6703f9727"},
+			{"", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d4846622bf9c6171ddd4c8f682080b03504eee"},
+			{"79656c6c6f777375626d6172696e65", "595694f9be48f03790f699455c84578b31d14a7baedfd736d73c53f66a5657"},
+			{"7375626d6172696e6579656c6c6f77", "621ae446b11fda3cf08e56102dac9324dee37a4e536cdc878e8b454d98bcf2"},
+		},
+	},
+	{
+		name:     "Noise_IK_25519_ChaChaPoly_BLAKE2s",
+		pattern:  noiseIK,
+		hash:     NoiseBLAKE2s,
+		prologue: "",
+		messages: []noiseVectorMessage{
+			{"746573745f6d73675f30", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254c9f0dff42c86abe5677abe74f6c87301577dbc1f3ffb2213827ca694a057fdbbff7f7350265fe61102c24d7d7a7e960b7316fcb3b0687be852fd2fba8969816fbfaa8b459d0b59e8a42f"},
+			{"746573745f6d73675f31", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d484667f1d8bd2b9b659695f9077e7062bb0b9e7c08fd627913be183c3"},
+			{"79656c6c6f777375626d6172696e65", "595694f9be48f03790f699455c84578b31d14a7baedfd736d73c53f66a5657"},
+			{"7375626d6172696e6579656c6c6f77", "621ae446b11fda3cf08e56102dac9324dee37a4e536cdc878e8b454d98bcf2"},
+		},
+	},
+	{
+		name:     "Noise_IK_25519_ChaChaPoly_BLAKE2s",
+		pattern:  noiseIK,
+		hash:     NoiseBLAKE2s,
+		prologue: "6e6f74736563726574",
+		messages: []noiseVectorMessage{
+			{"", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254c9f0dff42c86abe5677abe74f6c87301577dbc1f3ffb2213827ca694a057fdbbacac81d639bfae65c7827558f90acd27f14e182372e5bee2fa04eca3d32f09a9"},
+			{"", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466bbaba571a4d366dfe3958808b6a298f9"},
+			{"79656c6c6f777375626d6172696e65", "595694f9be48f03790f699455c84578b31d14a7baedfd736d73c53f66a5657"},
+			{"7375626d6172696e6579656c6c6f77", "621ae446b11fda3cf08e56102dac9324dee37a4e536cdc878e8b454d98bcf2"},
+		},
+	},
+	{
+		name:     "Noise_IK_25519_ChaChaPoly_BLAKE2s",
+		pattern:  noiseIK,
+		hash:     NoiseBLAKE2s,
+		prologue: "6e6f74736563726574",
+		messages: []noiseVectorMessage{
+			{"746573745f6d73675f30", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254c9f0dff42c86abe5677abe74f6c87301577dbc1f3ffb2213827ca694a057fdbbacac81d639bfae65c7827558f90acd277316fcb3b0687be852fd7e392456bb6cbe070c749f1bd7c55fc2"},
+			{"746573745f6d73675f31", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d484667f1d8bd2b9b659695f90e35beaf5a5f5f1e7c83aa3194a2430cd"},
+			{"79656c6c6f777375626d6172696e65", "595694f9be48f03790f699455c84578b31d14a7baedfd736d73c53f66a5657"},
+			{"7375626d6172696e6579656c6c6f77", "621ae446b11fda3cf08e56102dac9324dee37a4e536cdc878e8b454d98bcf2"},
+		},
+	},
+	{
+		name:     "Noise_XX_25519_ChaChaPoly_SHA256",
+		pattern:  noiseXX,
+		hash:     NoiseSHA256,
+		prologue: "",
+		messages: []noiseVectorMessage{
+			{"", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254"},
+			{"", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d484663414af878d3e46a2f58911a816d6e8346d4ea17a6f2a0bb4ef4ed56c133cff4560a34e36ea82109f26cf2e5a5caf992b608d55c747f615e5a3425a7a19eefb8f"},
+			{"", "87f864c11ba449f46a0a4f4e2eacbb7b0457784f4fca1937f572c93603e9c4d97e5ea11b16f3968710b23a3be3202dc1b5e1ce3c963347491e74f5c0768a9b42"},
+			{"79656c6c6f777375626d6172696e65", "a52ef02ba60e12696d1d6b9ef4245c88fca757b6134ad6e76b56e310a6adf6"},
+			{"7375626d6172696e6579656c6c6f77", "2445aa438ebd649281c636cc7269ca82f1d9023d72520943aeabf909cdf521"},
+		},
+	},
+	{
+		name:     "Noise_XX_25519_ChaChaPoly_SHA256",
+		pattern:  noiseXX,
+		hash:     NoiseSHA256,
+		prologue: "",
+		messages: []noiseVectorMessage{
+			{"746573745f6d73675f30", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254746573745f6d73675f30"},
+			{"746573745f6d73675f31", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d484663414af878d3e46a2f58911a816d6e8346d4ea17a6f2a0bb4ef4ed56c133cff4572e7a2ba5123ac30618b3d205f5c2d17f50cbca216483ac56bcc78e33bf520303278db641e5e731b2e3a"},
+			{"746573745f6d73675f32", "87f864c11ba449f46a0a4f4e2eacbb7b0457784f4fca1937f572c93603e9c4d9f27e318e43ba630594c4d08eeb3b36d97c7377a2f4f9144b2f0c8095ad92140505b2ab53eff244b14138"},
+			{"79656c6c6f777375626d6172696e65", "a52ef02ba60e12696d1d6b9ef4245c88fca757b6134ad6e76b56e310a6adf6"},
+			{"7375626d6172696e6579656c6c6f77", "2445aa438ebd649281c636cc7269ca82f1d9023d72520943aeabf909cdf521"},
+		},
+	},
+	{
+		name:     "Noise_XX_25519_ChaChaPoly_SHA256",
+		pattern:  noiseXX,
+		hash:     NoiseSHA256,
+		prologue: "6e6f74736563726574",
+		messages: []noiseVectorMessage{
+			{"", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254"},
+			{"", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d484663414af878d3e46a2f58911a816d6e8346d4ea17a6f2a0bb4ef4ed56c133cff4588f043d1e49a3289b1beeab8f96b0551a48cddf9f38b1a12e46c6908644198f3"},
+			{"", "87f864c11ba449f46a0a4f4e2eacbb7b0457784f4fca1937f572c93603e9c4d95a04fa1f1c41fb3f00d496f242c1e44ce5b749b3d54bf74cea2dad086d601fb6"},
+			{"79656c6c6f777375626d6172696e65", "a52ef02ba60e12696d1d6b9ef4245c88fca757b6134ad6e76b56e310a6adf6"},
+			{"7375626d6172696e6579656c6c6f77", "2445aa438ebd649281c636cc7269ca82f1d9023d72520943aeabf909cdf521"},
+		},
+	},
+	{
+		name:     "Noise_XX_25519_ChaChaPoly_SHA256",
+		pattern:  noiseXX,
+		hash:     NoiseSHA256,
+		prologue: "6e6f74736563726574",
+		messages: []noiseVectorMessage{
+			{"746573745f6d73675f30", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254746573745f6d73675f30"},
+			{"746573745f6d73675f31", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d484663414af878d3e46a2f58911a816d6e8346d4ea17a6f2a0bb4ef4ed56c133cff4545958c588d17d6373e0c1dcfa3755d37f50cbca216483ac56bcc98f5095870aa814ba40c08079c11f087"},
+			{"746573745f6d73675f32", "87f864c11ba449f46a0a4f4e2eacbb7b0457784f4fca1937f572c93603e9c4d9c1e9a1a313d02b78871cfd178a521a4c7c7377a2f4f9144b2f0ccedc84d379151b466741e4b266db6023"},
+			{"79656c6c6f777375626d6172696e65", "a52ef02ba60e12696d1d6b9ef4245c88fca757b6134ad6e76b56e310a6adf6"},
+			{"7375626d6172696e6579656c6c6f77", "2445aa438ebd649281c636cc7269ca82f1d9023d72520943aeabf909cdf521"},
+		},
+	},
+	{
+		name:     "Noise_IK_25519_ChaChaPoly_SHA256",
+		pattern:  noiseIK,
+		hash:     NoiseSHA256,
+		prologue: "",
+		messages: []noiseVectorMessage{
+			{"", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd1662544f8445e5dc2467b1e32653192d05dee85c4781bf0dd8d33ceebb5905a7a069f09e0d3f2cad1c842930a762eb75e52827f01d2c85189d527644b3221b4c3fc5cc"},
+			{"", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466aabfe2e5b1650bbaa88e33679893fc77"},
+			{"79656c6c6f777375626d6172696e65", "226ca869f2777611f37350a7ab446f650c0cfe2855b7f020ce658bcf100f2d"},
+			{"7375626d6172696e6579656c6c6f77", "90d84d69cd44829283b05d684879b53b8d714e51619b601438a1ae67caacd9"},
+		},
+	},
+	{
+		name:     "Noise_IK_25519_ChaChaPoly_SHA256",
+		pattern:  noiseIK,
+		hash:     NoiseSHA256,
+		prologue: "",
+		messages: []noiseVectorMessage{
+			{"746573745f6d73675f30", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd1662544f8445e5dc2467b1e32653192d05dee85c4781bf0dd8d33ceebb5905a7a069f09e0d3f2cad1c842930a762eb75e528270337527f958f92050deefa1892482d74328fee90d08201bba3cc"},
+			{"746573745f6d73675f31", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466cb4a35db52355821787bb891112ba10f4d3dfe08b27d634db8af"},
+			{"79656c6c6f777375626d6172696e65", "226ca869f2777611f37350a7ab446f650c0cfe2855b7f020ce658bcf100f2d"},
+			{"7375626d6172696e6579656c6c6f77", "90d84d69cd44829283b05d684879b53b8d714e51619b601438a1ae67caacd9"},
+		},
+	},
+	{
+		name:     "Noise_IK_25519_ChaChaPoly_SHA256",
+		pattern:  noiseIK,
+		hash:     NoiseSHA256,
+		prologue: "6e6f74736563726574",
+		messages: []noiseVectorMessage{
+			{"", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd1662544f8445e5dc2467b1e32653192d05dee85c4781bf0dd8d33ceebb5905a7a069f0d6bc97dbce6f8f0ee33d49311a72d0f8c4ef8ef3bc70ccb18fd61ad67dde7eda"},
+			{"", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466787857f66c036e974ef9d6335d2ccc5f"},
+			{"79656c6c6f777375626d6172696e65", "226ca869f2777611f37350a7ab446f650c0cfe2855b7f020ce658bcf100f2d"},
+			{"7375626d6172696e6579656c6c6f77", "90d84d69cd44829283b05d684879b53b8d714e51619b601438a1ae67caacd9"},
+		},
+	},
+	{
+		name:     "Noise_IK_25519_ChaChaPoly_SHA256",
+		pattern:  noiseIK,
+		hash:     NoiseSHA256,
+		prologue: "6e6f74736563726574",
+		messages: []noiseVectorMessage{
+			{"746573745f6d73675f30", "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd1662544f8445e5dc2467b1e32653192d05dee85c4781bf0dd8d33ceebb5905a7a069f0d6bc97dbce6f8f0ee33d49311a72d0f80337527f958f92050deee33c19777fa17306346367055751bb3f"},
+			{"746573745f6d73675f31", "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466cb4a35db52355821787bb67f33957e7809370c44d33538ad5a42"},
+			{"79656c6c6f777375626d6172696e65", "226ca869f2777611f37350a7ab446f650c0cfe2855b7f020ce658bcf100f2d"},
+			{"7375626d6172696e6579656c6c6f77", "90d84d69cd44829283b05d684879b53b8d714e51619b601438a1ae67caacd9"},
+		},
+	},
+}
+
+type noiseVectorMessage struct {
+	payload, ciphertext string
+}
+
+func noiseTestKeyPair(t *testing.T, private string) noiseKeyPair {
+	var kp noiseKeyPair
+	copy(kp.private[:], mustDecodeHex(t, private))
+	public, err := curve25519.X25519(kp.private[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(kp.public[:], public)
+	return kp
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestNoiseVectors(t *testing.T) {
+	initStatic := noiseTestKeyPair(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	respStatic := noiseTestKeyPair(t, "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20")
+
+	for _, v := range noiseVectors {
+		hashFunc, hashName := noiseHashFunc(v.hash)
+		var rs *[keySize]byte
+		if v.pattern.responderPreMessage {
+			rs = &respStatic.public
+		}
+		prologue := mustDecodeHex(t, v.prologue)
+		initiator, err := newNoiseHandshakeState(v.pattern, hashFunc, hashName, true, prologue, initStatic, rs,
+			bytes.NewReader(mustDecodeHex(t, "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		responder, err := newNoiseHandshakeState(v.pattern, hashFunc, hashName, false, prologue, respStatic, nil,
+			bytes.NewReader(mustDecodeHex(t, "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handshakeMessages := len(v.pattern.messages)
+		for i := 0; i < handshakeMessages; i++ {
+			writer, reader := initiator, responder
+			if i%2 != 0 {
+				writer, reader = responder, initiator
+			}
+			expected := v.messages[i]
+			msg, err := writer.writeMessage(mustDecodeHex(t, expected.payload))
+			if err != nil {
+				t.Fatalf("%s: message %d: %v", v.name, i, err)
+			}
+			if got := hex.EncodeToString(msg); got != expected.ciphertext {
+				t.Fatalf("%s: message %d: expected %s, got %s", v.name, i, expected.ciphertext, got)
+			}
+			payload, err := reader.readMessage(msg)
+			if err != nil {
+				t.Fatalf("%s: message %d: failed to read: %v", v.name, i, err)
+			}
+			if got := hex.EncodeToString(payload); got != expected.payload {
+				t.Fatalf("%s: message %d: expected payload %s, got %s", v.name, i, expected.payload, got)
+			}
+		}
+		if !initiator.finished() || !responder.finished() {
+			t.Fatalf("%s: expected handshake to be finished", v.name)
+		}
+		if initiator.rs != respStatic.public || responder.rs != initStatic.public {
+			t.Fatalf("%s: expected both sides to learn the other's static key", v.name)
+		}
+
+		initSend, initRecv := initiator.transportKeys()
+		respSend, respRecv := responder.transportKeys()
+		if initSend != respRecv || initRecv != respSend {
+			t.Fatalf("%s: expected matching transport keys", v.name)
+		}
+		for i, key := range []*[keySize]byte{&initSend, &respSend} {
+			expected := v.messages[handshakeMessages+i]
+			sealed := noiseEncrypt(key, 0, nil, mustDecodeHex(t, expected.payload))
+			if got := hex.EncodeToString(sealed); got != expected.ciphertext {
+				t.Fatalf("%s: transport message %d: expected %s, got %s", v.name, i, expected.ciphertext, got)
+			}
+		}
+	}
+}
+
+func noiseTestConfigs(mode Mode, hash NoiseHash) (*Config, *Config) {
+	client, server := testConfigs()
+	client.Mode, server.Mode = mode, mode
+	client.NoiseHash, server.NoiseHash = hash, hash
+	client.Initiator = true
+	client.PeerKey = server.PublicKey
+	return client, server
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	for _, mode := range []Mode{ModeNoiseXX, ModeNoiseIK} {
+		for _, hash := range []NoiseHash{NoiseBLAKE2s, NoiseSHA256} {
+			clientConfig, serverConfig := noiseTestConfigs(mode, hash)
+			clientConfig.RekeyAfterMessages = 2
+			client, server := handshakePairConfig(t, clientConfig, serverConfig)
+
+			if client.PeerKey() != serverConfig.PublicKey || server.PeerKey() != clientConfig.PublicKey {
+				t.Fatalf("mode %d: expected both sides to know the peer's key", mode)
+			}
+
+			// enough messages to rekey a few times
+			done := make(chan error, 1)
+			go func() {
+				for i := 0; i < 5; i++ {
+					if _, err := client.Write([]byte("Hello World")); err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- client.Close()
+			}()
+			data, err := ioutil.ReadAll(server)
+			if err != nil {
+				t.Fatalf("mode %d: failed to read: %v", mode, err)
+			}
+			if err := <-done; err != nil {
+				t.Fatalf("mode %d: failed to write: %v", mode, err)
+			}
+			if string(data) != "Hello WorldHello WorldHello WorldHello WorldHello World" {
+				t.Fatalf("mode %d: unexpected data %q", mode, data)
+			}
+			server.Close()
+		}
+	}
+}
+
+func TestNoiseHandshakeErrors(t *testing.T) {
+	// the IK initiator has to know the responder's key
+	clientConfig, _ := noiseTestConfigs(ModeNoiseIK, NoiseBLAKE2s)
+	clientConfig.PeerKey = zeroKey
+	c1, c2 := tcpPipe(t)
+	defer c1.Close()
+	defer c2.Close()
+	if _, err := HandshakeConfig(c1, clientConfig); err != ErrNoPeerKey {
+		t.Fatalf("expected ErrNoPeerKey, got %v", err)
+	}
+
+	// the responder refuses unknown initiators
+	clientConfig, serverConfig := noiseTestConfigs(ModeNoiseXX, NoiseBLAKE2s)
+	serverConfig.KeyStore = KeyList(nil)
+	c1, c2 = tcpPipe(t)
+	defer c1.Close()
+	defer c2.Close()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := HandshakeConfig(c2, serverConfig)
+		c2.Close()
+		errs <- err
+	}()
+	HandshakeConfig(c1, clientConfig)
+	if err := <-errs; !errors.Is(err, ErrKeyNotAllowed) {
+		t.Fatalf("expected ErrKeyNotAllowed, got %v", err)
+	}
+
+	// an IK initiator with the wrong responder key fails
+	clientConfig, serverConfig = noiseTestConfigs(ModeNoiseIK, NoiseBLAKE2s)
+	other, _ := noiseTestConfigs(ModeNoiseIK, NoiseBLAKE2s)
+	clientConfig.PeerKey = other.PublicKey
+	clientConfig.KeyStore = KeyList([][keySize]byte{other.PublicKey})
+	c1, c2 = tcpPipe(t)
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		_, err := HandshakeConfig(c2, serverConfig)
+		c2.Close()
+		errs <- err
+	}()
+	HandshakeConfig(c1, clientConfig)
+	if err := <-errs; err != ErrInvalidHandshake {
+		t.Fatalf("expected ErrInvalidHandshake, got %v", err)
+	}
+}
+
+func TestNoiseListener(t *testing.T) {
+	clientConfig, serverConfig := noiseTestConfigs(ModeNoiseIK, NoiseBLAKE2s)
+	// Dial and Listen pick the roles themselves
+	clientConfig.Initiator = false
+
+	l, err := ListenConfig("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := DialConfig("tcp", l.Addr().String(), clientConfig)
+		if err != nil {
+			t.Errorf("failed to dial: %v", err)
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("Hello World"))
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer c.Close()
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "Hello World" {
+		t.Errorf("expected %q, got %q %v", "Hello World", buf[:n], err)
+	}
+}
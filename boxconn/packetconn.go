@@ -0,0 +1,802 @@
+package boxconn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/nacl/box"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// datagram types, the first byte of every datagram
+const (
+	datagramHello byte = iota + 1
+	datagramHelloReply
+	datagramData
+	datagramConfirm
+	datagramCookie
+)
+
+const (
+	counterSize = 8
+	// maxDatagramSize is the largest datagram we read
+	maxDatagramSize = 65535
+	// helloRetryInterval is how often a hello is resent while we wait for a
+	// reply
+	helloRetryInterval = 250 * time.Millisecond
+	// replayWindowSize is how far out of order a datagram may arrive
+	replayWindowSize = 64
+	// incomingQueueSize is the number of datagrams waiting for ReadFrom,
+	// anything more is dropped
+	incomingQueueSize = 128
+	// maxPacketSessions is the number of sessions peers may start with us,
+	// hellos from new addresses are dropped once it is reached
+	maxPacketSessions = 1024
+	// cookieSize is the length of the cookie a hello has to echo, and
+	// cookieInterval how long a cookie stays valid, between one and two
+	// intervals
+	cookieSize     = 16
+	cookieInterval = 2 * time.Minute
+)
+
+type (
+	// PacketConn is a secure packet connection over an underlying
+	// net.PacketConn. Each peer address gets its own session, established
+	// by a handshake the first time we write to it or it writes to us. Every
+	// datagram is sealed on its own, so datagrams may be lost or reordered,
+	// but a datagram is never delivered twice.
+	//
+	// Sessions are never rekeyed. When a peer starts a new session, for
+	// example after a restart, we keep using the old one until the peer
+	// proves it has the new keys.
+	//
+	// Hellos are only answered once they echo a cookie we sent to their
+	// address, so spoofed addresses cost us no more than a hash. Peers may
+	// start at most maxPacketSessions sessions, and a session the peer
+	// doesn't confirm within Config.HandshakeTimeout is forgotten.
+	PacketConn struct {
+		underlying   net.PacketConn
+		config       *Config
+		cookieSecret [32]byte
+
+		mu       sync.Mutex
+		sessions map[string]*packetSession
+
+		incoming chan packet
+		closed   chan struct{}
+		closeErr error
+		once     sync.Once
+
+		deadlineMu      sync.Mutex
+		readDeadline    time.Time
+		deadlineChanged chan struct{}
+	}
+	packet struct {
+		data []byte
+		addr net.Addr
+	}
+	// packetSession is the state we keep for a peer address. It is guarded
+	// by PacketConn.mu.
+	packetSession struct {
+		addr     net.Addr
+		identity Identity
+
+		// our hello and the peer's
+		hello, peerHello []byte
+		// reply is the hello reply we sent as the responder, which is
+		// resent if the peer sends its hello again
+		reply []byte
+		// confirmation is the datagram we sent as the initiator to prove we
+		// have the keys, which is resent if the peer doesn't use them
+		confirmation []byte
+		// ephemeralPrivateKey is set while we wait for a hello reply, and
+		// cookie once the peer asked us to echo one with our hello
+		ephemeralPrivateKey *[keySize]byte
+		cookie              []byte
+
+		keys *packetKeys
+		// previous keys are kept after a peer starts a new session, until
+		// the new one is used
+		previous *packetKeys
+		// pending is a handshake we answered as the responder. Hellos
+		// aren't authenticated, so its keys aren't used until the peer
+		// proves it has them.
+		pending *packetHandshake
+
+		// established is closed once keys are available
+		established chan struct{}
+	}
+	packetHandshake struct {
+		identity         Identity
+		peerHello, reply []byte
+		keys             *packetKeys
+	}
+	packetKeys struct {
+		sendKey, recvKey [keySize]byte
+		sendCounter      uint64
+		window           replayWindow
+	}
+	// replayWindow tracks which of the most recent counters have been seen
+	replayWindow struct {
+		highest uint64
+		bitmap  uint64
+	}
+)
+
+// ListenPacket listens on the local network address and wraps the
+// connection in a secure packet connection. (See net.ListenPacket for
+// details on network and address).
+func ListenPacket(network, address string, config *Config) (*PacketConn, error) {
+	underlying, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewPacketConn(underlying, config)
+	if err != nil {
+		underlying.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewPacketConn wraps an existing packet connection. Peers are allowed by
+// Config.KeyStore and Config.Revocations. The datagram handshake has no
+// Noise modes and carries no certificates, so a config which sets Mode,
+// Certificate or CertificateAuthorities is rejected.
+func NewPacketConn(underlying net.PacketConn, config *Config) (*PacketConn, error) {
+	switch {
+	case config.Mode != ModeBox:
+		return nil, fmt.Errorf("boxconn: PacketConn doesn't support Mode %d", config.Mode)
+	case config.Certificate != nil:
+		return nil, fmt.Errorf("boxconn: PacketConn doesn't support Certificate")
+	case len(config.CertificateAuthorities) > 0:
+		return nil, fmt.Errorf("boxconn: PacketConn doesn't support CertificateAuthorities")
+	case len(config.PreSharedKey) > 0 && len(config.PreSharedKey) < MinPreSharedKeySize:
+		return nil, ErrPreSharedKeyTooShort
+	}
+
+	c := &PacketConn{
+		underlying:      underlying,
+		config:          config,
+		sessions:        make(map[string]*packetSession),
+		incoming:        make(chan packet, incomingQueueSize),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	if _, err := crand.Read(c.cookieSecret[:]); err != nil {
+		return nil, err
+	}
+	go c.serve()
+	return c, nil
+}
+
+// ReadFrom reads the next datagram from any peer. Datagrams which fail to
+// decrypt, arrive twice or come from peers we don't allow are dropped.
+func (c *PacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		c.deadlineMu.Lock()
+		deadline, changed := c.readDeadline, c.deadlineChanged
+		c.deadlineMu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case pkt := <-c.incoming:
+			n, addr = copy(b, pkt.data), pkt.addr
+		case <-c.closed:
+			err = c.closeErr
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if addr != nil || err != nil {
+			return n, addr, err
+		}
+	}
+}
+
+// WriteTo seals b and writes it to addr. If we don't have a session with
+// addr yet, WriteTo performs the handshake first.
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	s, err := c.session(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	keys := s.keys
+	keys.sendCounter++
+	datagram := sealDatagram(keys.sendCounter, b, &keys.sendKey)
+	peerKey := s.identity.Key
+	c.mu.Unlock()
+
+	_, err = c.underlying.WriteTo(datagram, addr)
+	if err != nil {
+		return 0, err
+	}
+	c.trace(peerKey, Event{Type: FrameWritten, Size: len(datagram)})
+	return len(b), nil
+}
+
+// PeerIdentity returns the identity of the peer at addr, if we have a
+// session with it
+func (c *PacketConn) PeerIdentity(addr net.Addr) (Identity, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.sessions[addr.String()]
+	if !ok || s.keys == nil {
+		return Identity{}, false
+	}
+	return s.identity, true
+}
+
+// Close closes the connection.
+// Any blocked ReadFrom or WriteTo operations will be unblocked and return errors.
+func (c *PacketConn) Close() error {
+	c.shutdown(errClosing)
+	return c.underlying.Close()
+}
+
+// LocalAddr returns the local network address.
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.underlying.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadlines associated
+// with the connection.
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future ReadFrom calls and any
+// currently-blocked ReadFrom call.
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	c.deadlineMu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future WriteTo calls.
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return c.underlying.SetWriteDeadline(t)
+}
+
+func (c *PacketConn) shutdown(err error) {
+	c.once.Do(func() {
+		c.closeErr = err
+		close(c.closed)
+	})
+}
+
+func (c *PacketConn) trace(peerKey [keySize]byte, evt Event) {
+	evt.PeerKey = peerKey
+	c.config.tracer().Trace(evt)
+}
+
+// session returns the established session with addr, starting a handshake
+// if there isn't one
+func (c *PacketConn) session(addr net.Addr) (*packetSession, error) {
+	c.mu.Lock()
+	s, ok := c.sessions[addr.String()]
+	if !ok {
+		s = &packetSession{
+			addr:        addr,
+			established: make(chan struct{}),
+		}
+		c.sessions[addr.String()] = s
+	}
+	var hello []byte
+	var err error
+	// unless the peer has started a handshake we can finish
+	if s.keys == nil && s.pending == nil && s.ephemeralPrivateKey == nil {
+		hello, err = c.initiate(s)
+	}
+	c.mu.Unlock()
+	if err == nil && hello != nil {
+		_, err = c.underlying.WriteTo(hello, addr)
+	}
+	if err != nil {
+		c.abandon(s)
+		return nil, err
+	}
+
+	var deadline <-chan time.Time
+	if timeout := c.config.handshakeTimeout(); timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	retry := time.NewTicker(helloRetryInterval)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-s.established:
+			return s, nil
+		case <-c.closed:
+			return nil, c.closeErr
+		case <-deadline:
+			c.abandon(s)
+			return nil, os.ErrDeadlineExceeded
+		case <-retry.C:
+			// if a hello we answered wasn't confirmed by now, it may not
+			// have come from the peer, so start our own handshake
+			c.mu.Lock()
+			hello, err := c.initiate(s)
+			c.mu.Unlock()
+			if err == nil && hello != nil {
+				c.underlying.WriteTo(hello, addr)
+			}
+		}
+	}
+}
+
+// abandon forgets a session whose handshake failed
+func (c *PacketConn) abandon(s *packetSession) {
+	c.mu.Lock()
+	if c.sessions[s.addr.String()] == s && s.keys == nil {
+		delete(c.sessions, s.addr.String())
+	}
+	c.mu.Unlock()
+}
+
+// initiate returns the hello to send while s isn't established, starting a
+// handshake as the initiator if we haven't yet. c.mu must be held.
+func (c *PacketConn) initiate(s *packetSession) ([]byte, error) {
+	if s.keys != nil {
+		return nil, nil
+	}
+	if s.ephemeralPrivateKey == nil {
+		ephemeralPublicKey, ephemeralPrivateKey, err := box.GenerateKey(crand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		s.hello = c.newHello(ephemeralPublicKey)
+		s.ephemeralPrivateKey = ephemeralPrivateKey
+		s.cookie = nil
+		c.trace(zeroKey, Event{Type: HandshakeStart})
+	}
+	hello := append([]byte{datagramHello}, s.hello...)
+	return append(hello, s.cookie...), nil
+}
+
+func (c *PacketConn) newHello(ephemeralPublicKey *[keySize]byte) []byte {
+	hello := make([]byte, 0, 2*keySize)
+	hello = append(hello, c.config.PublicKey[:]...)
+	hello = append(hello, ephemeralPublicKey[:]...)
+	return hello
+}
+
+// serve reads datagrams from the underlying connection until it fails
+func (c *PacketConn) serve() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := c.underlying.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			c.shutdown(err)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		c.trace(zeroKey, Event{Type: FrameRead, Size: n})
+
+		datagram := buf[:n]
+		switch datagram[0] {
+		case datagramHello:
+			c.handleHello(datagram[1:], addr)
+		case datagramHelloReply:
+			c.handleHelloReply(datagram[1:], addr)
+		case datagramData:
+			c.handleData(datagram[1:], addr)
+		case datagramConfirm:
+			c.handleConfirm(datagram[1:], addr)
+		case datagramCookie:
+			c.handleCookie(datagram[1:], addr)
+		}
+	}
+}
+
+// handleHello answers a hello from a peer, making us the responder. A hello
+// without a valid cookie is answered with one, which proves the peer can
+// receive at its address before we do any work for it.
+func (c *PacketConn) handleHello(datagram []byte, addr net.Addr) {
+	if len(datagram) != 2*keySize && len(datagram) != 2*keySize+cookieSize {
+		return
+	}
+	peerHello, cookie := datagram[:2*keySize], datagram[2*keySize:]
+	if !c.checkCookie(cookie, peerHello, addr) {
+		now := time.Now().Unix() / int64(cookieInterval/time.Second)
+		reply := append([]byte{datagramCookie}, c.makeCookie(now, peerHello, addr)...)
+		c.underlying.WriteTo(reply, addr)
+		return
+	}
+	if reply := c.answerHello(peerHello, addr); reply != nil {
+		c.underlying.WriteTo(reply, addr)
+	}
+}
+
+// makeCookie returns the cookie for a hello from addr during interval
+func (c *PacketConn) makeCookie(interval int64, peerHello []byte, addr net.Addr) []byte {
+	mac := hmac.New(sha256.New, c.cookieSecret[:])
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(interval))
+	mac.Write(buf[:])
+	mac.Write([]byte(addr.String()))
+	mac.Write(peerHello)
+	return mac.Sum(nil)[:cookieSize]
+}
+
+// checkCookie returns true if cookie is what we sent to addr for the hello
+// during this interval or the one before
+func (c *PacketConn) checkCookie(cookie, peerHello []byte, addr net.Addr) bool {
+	if len(cookie) != cookieSize {
+		return false
+	}
+	now := time.Now().Unix() / int64(cookieInterval/time.Second)
+	return hmac.Equal(cookie, c.makeCookie(now, peerHello, addr)) ||
+		hmac.Equal(cookie, c.makeCookie(now-1, peerHello, addr))
+}
+
+// handleCookie sends our hello again with the cookie the peer asked for
+func (c *PacketConn) handleCookie(cookie []byte, addr net.Addr) {
+	if len(cookie) != cookieSize {
+		return
+	}
+
+	c.mu.Lock()
+	s := c.sessions[addr.String()]
+	if s == nil || s.keys != nil || s.ephemeralPrivateKey == nil {
+		c.mu.Unlock()
+		return
+	}
+	s.cookie = append([]byte(nil), cookie...)
+	hello, err := c.initiate(s)
+	c.mu.Unlock()
+	if err == nil && hello != nil {
+		c.underlying.WriteTo(hello, addr)
+	}
+}
+
+// answerHello derives keys for a hello from a peer and returns the reply.
+// The keys are kept pending until the peer confirms them, anyone can send a
+// hello with the peer's public key.
+func (c *PacketConn) answerHello(peerHello []byte, addr net.Addr) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.sessions[addr.String()]
+	if s != nil {
+		// the peer didn't get our reply, send it again
+		if s.pending != nil && bytes.Equal(s.pending.peerHello, peerHello) {
+			return s.pending.reply
+		}
+		if s.reply != nil && bytes.Equal(s.peerHello, peerHello) {
+			return s.reply
+		}
+		// both sides started a handshake at the same time. The one with the
+		// lower hello stays the initiator.
+		if s.ephemeralPrivateKey != nil && bytes.Compare(s.hello, peerHello) < 0 {
+			return nil
+		}
+	}
+
+	var peerKey, peerEphemeralKey [keySize]byte
+	copy(peerKey[:], peerHello[:keySize])
+	copy(peerEphemeralKey[:], peerHello[keySize:2*keySize])
+	if s == nil && len(c.sessions) >= maxPacketSessions {
+		return nil
+	}
+	name, err := c.authorize(peerKey)
+	if err != nil {
+		c.trace(peerKey, Event{Type: HandshakeFinish, Err: err})
+		return nil
+	}
+
+	ephemeralPublicKey, ephemeralPrivateKey, err := box.GenerateKey(crand.Reader)
+	if err != nil {
+		return nil
+	}
+	defer clearKey(ephemeralPrivateKey)
+	hello := c.newHello(ephemeralPublicKey)
+
+	keys := new(packetKeys)
+	keys.sendKey, keys.recvKey, err = deriveSessionKeys(hello, peerHello, &c.config.PrivateKey, ephemeralPrivateKey, &peerKey, &peerEphemeralKey, c.config.PreSharedKey)
+	if err != nil {
+		c.trace(peerKey, Event{Type: HandshakeFinish, Err: err})
+		return nil
+	}
+
+	// the reply proves we have the keys, sealed with counter 0
+	reply := append([]byte{datagramHelloReply}, hello...)
+	reply = append(reply, box.SealAfterPrecomputation(nil, nil, counterNonce(0), &keys.sendKey)...)
+
+	if s == nil {
+		s = &packetSession{
+			addr:        addr,
+			established: make(chan struct{}),
+		}
+		c.sessions[addr.String()] = s
+	}
+	pending := &packetHandshake{
+		identity:  Identity{Key: peerKey, Name: name},
+		peerHello: append([]byte(nil), peerHello...),
+		reply:     reply,
+		keys:      keys,
+	}
+	s.pending = pending
+	time.AfterFunc(c.pendingTimeout(), func() {
+		c.expire(s, pending)
+	})
+	return reply
+}
+
+// pendingTimeout is how long a handshake we answered waits for the peer to
+// confirm it
+func (c *PacketConn) pendingTimeout() time.Duration {
+	if timeout := c.config.handshakeTimeout(); timeout > 0 {
+		return timeout
+	}
+	return DefaultHandshakeTimeout
+}
+
+// expire forgets a handshake we answered if the peer never confirmed it,
+// along with the session if that's all there was
+func (c *PacketConn) expire(s *packetSession, pending *packetHandshake) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s.pending != pending {
+		return
+	}
+	s.pending = nil
+	if c.sessions[s.addr.String()] == s && s.keys == nil && s.ephemeralPrivateKey == nil {
+		delete(c.sessions, s.addr.String())
+	}
+}
+
+// handleHelloReply completes a handshake we started
+func (c *PacketConn) handleHelloReply(reply []byte, addr net.Addr) {
+	if len(reply) != 2*keySize+box.Overhead {
+		return
+	}
+	if confirmation := c.finishHandshake(reply, addr); confirmation != nil {
+		c.underlying.WriteTo(confirmation, addr)
+	}
+}
+
+// finishHandshake establishes the session from a hello reply and returns
+// the datagram which confirms it to the peer
+func (c *PacketConn) finishHandshake(reply []byte, addr net.Addr) []byte {
+	peerHello := reply[:2*keySize]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.sessions[addr.String()]
+	if s == nil || s.keys != nil || s.ephemeralPrivateKey == nil {
+		return nil
+	}
+
+	var peerKey, peerEphemeralKey [keySize]byte
+	copy(peerKey[:], peerHello[:keySize])
+	copy(peerEphemeralKey[:], peerHello[keySize:])
+	name, err := c.authorize(peerKey)
+	if err != nil {
+		c.trace(peerKey, Event{Type: HandshakeFinish, Err: err})
+		return nil
+	}
+
+	keys := new(packetKeys)
+	keys.sendKey, keys.recvKey, err = deriveSessionKeys(s.hello, peerHello, &c.config.PrivateKey, s.ephemeralPrivateKey, &peerKey, &peerEphemeralKey, c.config.PreSharedKey)
+	if err != nil {
+		return nil
+	}
+	if _, ok := box.OpenAfterPrecomputation(nil, reply[2*keySize:], counterNonce(0), &keys.recvKey); !ok {
+		c.trace(peerKey, Event{Type: DecryptError, Err: ErrDecrypt})
+		return nil
+	}
+	keys.window.update(0)
+
+	clearKey(s.ephemeralPrivateKey)
+	s.ephemeralPrivateKey = nil
+	s.identity = Identity{Key: peerKey, Name: name}
+	s.peerHello = append([]byte(nil), peerHello...)
+	s.keys = keys
+	// the peer answered our hello, so a hello we answered is stale
+	s.pending = nil
+	// we prove we have the keys the same way, with our counter 0
+	s.confirmation = append([]byte{datagramConfirm}, box.SealAfterPrecomputation(nil, nil, counterNonce(0), &keys.sendKey)...)
+	c.trace(peerKey, Event{Type: HandshakeFinish})
+	close(s.established)
+	return s.confirmation
+}
+
+// handleConfirm switches to the keys of a handshake we answered once the
+// peer proves it has them
+func (c *PacketConn) handleConfirm(sealed []byte, addr net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.sessions[addr.String()]
+	if s == nil || s.pending == nil {
+		return
+	}
+	if _, err := s.pending.keys.open(0, sealed); err != nil {
+		c.trace(s.pending.identity.Key, Event{Type: DecryptError, Err: err})
+		return
+	}
+	s.confirm()
+	c.trace(s.identity.Key, Event{Type: HandshakeFinish})
+}
+
+// handleData opens a data datagram and queues it for ReadFrom
+func (c *PacketConn) handleData(datagram []byte, addr net.Addr) {
+	if len(datagram) < counterSize+box.Overhead {
+		return
+	}
+	counter := binary.BigEndian.Uint64(datagram[:counterSize])
+
+	c.mu.Lock()
+	s := c.sessions[addr.String()]
+	if s == nil || (s.keys == nil && s.pending == nil) {
+		c.mu.Unlock()
+		return
+	}
+	confirming := s.pending != nil
+	data, err := s.open(counter, datagram[counterSize:])
+	peerKey := s.identity.Key
+	confirmation := s.confirmation
+	if confirming && s.pending == nil {
+		c.trace(peerKey, Event{Type: HandshakeFinish})
+	}
+	c.mu.Unlock()
+	if err != nil {
+		// the peer keeps sending with its old keys until it gets our
+		// confirmation, which may have been lost
+		if err == ErrDecrypt && confirmation != nil {
+			c.underlying.WriteTo(confirmation, addr)
+		}
+		typ := DecryptError
+		if err == ErrInvalidNonce {
+			typ = NonceError
+		}
+		c.trace(peerKey, Event{Type: typ, Size: len(datagram), Err: err})
+		return
+	}
+
+	select {
+	case c.incoming <- packet{data, addr}:
+	default:
+	}
+}
+
+// authorize decides whether a peer's key is allowed the same way the stream
+// handshake does, and returns the peer's name
+func (c *PacketConn) authorize(key [keySize]byte) (string, error) {
+	p := &Protocol{config: c.config}
+	if err := p.authorize(c.config, key, nil); err != nil {
+		return "", err
+	}
+	return p.peerName, nil
+}
+
+// open decrypts a datagram with the current keys, or the previous ones if
+// the peer hasn't switched yet. Data sealed with pending keys confirms them.
+func (s *packetSession) open(counter uint64, sealed []byte) ([]byte, error) {
+	if s.pending != nil {
+		if data, err := s.pending.keys.open(counter, sealed); err == nil {
+			s.confirm()
+			return data, nil
+		}
+		if s.keys == nil {
+			return nil, ErrDecrypt
+		}
+	}
+	data, err := s.keys.open(counter, sealed)
+	if err == ErrDecrypt && s.previous != nil {
+		return s.previous.open(counter, sealed)
+	}
+	if err == nil {
+		s.previous = nil
+	}
+	return data, err
+}
+
+// confirm switches to the keys of the pending handshake, keeping the current
+// ones for datagrams the peer sent before it switched
+func (s *packetSession) confirm() {
+	p := s.pending
+	s.pending = nil
+	if s.ephemeralPrivateKey != nil {
+		// we lost a handshake started at the same time
+		clearKey(s.ephemeralPrivateKey)
+		s.ephemeralPrivateKey = nil
+	}
+	s.previous = s.keys
+	s.identity = p.identity
+	s.hello, s.peerHello, s.reply, s.confirmation = nil, p.peerHello, p.reply, nil
+	s.keys = p.keys
+	if s.previous == nil {
+		close(s.established)
+	}
+}
+
+func (k *packetKeys) open(counter uint64, sealed []byte) ([]byte, error) {
+	if !k.window.check(counter) {
+		return nil, ErrInvalidNonce
+	}
+	data, ok := box.OpenAfterPrecomputation(nil, sealed, counterNonce(counter), &k.recvKey)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	k.window.update(counter)
+	return data, nil
+}
+
+func sealDatagram(counter uint64, data []byte, key *[keySize]byte) []byte {
+	datagram := make([]byte, 1+counterSize, 1+counterSize+len(data)+box.Overhead)
+	datagram[0] = datagramData
+	binary.BigEndian.PutUint64(datagram[1:], counter)
+	return box.SealAfterPrecomputation(datagram, data, counterNonce(counter), key)
+}
+
+// counterNonce returns the nonce for a datagram counter
+func counterNonce(counter uint64) *[nonceSize]byte {
+	var nonce [nonceSize]byte
+	binary.BigEndian.PutUint64(nonce[nonceSize-counterSize:], counter)
+	return &nonce
+}
+
+// check returns true if counter hasn't been seen and isn't too old
+func (w *replayWindow) check(counter uint64) bool {
+	if counter > w.highest {
+		return true
+	}
+	if w.highest-counter >= replayWindowSize {
+		return false
+	}
+	return w.bitmap&(1<<(w.highest-counter)) == 0
+}
+
+// update marks counter as seen
+func (w *replayWindow) update(counter uint64) {
+	if counter > w.highest {
+		shift := counter - w.highest
+		if shift >= replayWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.highest = counter
+		return
+	}
+	w.bitmap |= 1 << (w.highest - counter)
+}
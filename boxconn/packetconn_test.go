@@ -0,0 +1,310 @@
+package boxconn
+
+import (
+	"crypto/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/nacl/box"
+)
+
+// holdingPacketConn holds on to data datagrams instead of sending them
+// while hold is set
+type holdingPacketConn struct {
+	net.PacketConn
+
+	mu   sync.Mutex
+	hold bool
+	held [][]byte
+}
+
+func (hpc *holdingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	hpc.mu.Lock()
+	defer hpc.mu.Unlock()
+	if hpc.hold && b[0] == datagramData {
+		hpc.held = append(hpc.held, append([]byte(nil), b...))
+		return len(b), nil
+	}
+	return hpc.PacketConn.WriteTo(b, addr)
+}
+
+func packetConnPair(t *testing.T) (*PacketConn, *PacketConn, *holdingPacketConn) {
+	clientConfig, serverConfig := testConfigs()
+	return packetConnPairConfig(t, clientConfig, serverConfig)
+}
+
+func packetConnPairConfig(t *testing.T, clientConfig, serverConfig *Config) (*PacketConn, *PacketConn, *holdingPacketConn) {
+	underlying, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	hpc := &holdingPacketConn{PacketConn: underlying}
+	client, err := NewPacketConn(hpc, clientConfig)
+	if err != nil {
+		t.Fatalf("failed to create packet conn: %v", err)
+	}
+
+	server, err := ListenPacket("udp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	return client, server, hpc
+}
+
+func readPacket(t *testing.T, c *PacketConn) (string, net.Addr) {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, addr, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	return string(buf[:n]), addr
+}
+
+func TestPacketConn(t *testing.T) {
+	client, server, _ := packetConnPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	_, err := client.WriteTo([]byte("ping"), server.LocalAddr())
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	msg, addr := readPacket(t, server)
+	if msg != "ping" {
+		t.Errorf("expected %q, got %q", "ping", msg)
+	}
+	if id, ok := server.PeerIdentity(addr); !ok || id.Key != client.config.PublicKey {
+		t.Errorf("expected the client's identity, got %v", id)
+	}
+
+	_, err = server.WriteTo([]byte("pong"), addr)
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	msg, _ = readPacket(t, client)
+	if msg != "pong" {
+		t.Errorf("expected %q, got %q", "pong", msg)
+	}
+}
+
+func TestPacketConnReplay(t *testing.T) {
+	client, server, hpc := packetConnPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	client.WriteTo([]byte("hello"), server.LocalAddr())
+	readPacket(t, server)
+
+	// hold on to a few datagrams, then deliver them out of order and twice
+	hpc.mu.Lock()
+	hpc.hold = true
+	hpc.mu.Unlock()
+	for _, msg := range []string{"1", "2", "3"} {
+		client.WriteTo([]byte(msg), server.LocalAddr())
+	}
+	hpc.mu.Lock()
+	hpc.hold = false
+	held := hpc.held
+	hpc.mu.Unlock()
+
+	for _, i := range []int{2, 0, 2, 1, 0} {
+		hpc.PacketConn.WriteTo(held[i], server.LocalAddr())
+	}
+	client.WriteTo([]byte("done"), server.LocalAddr())
+
+	var received []string
+	for {
+		msg, _ := readPacket(t, server)
+		if msg == "done" {
+			break
+		}
+		received = append(received, msg)
+	}
+	if len(received) != 3 || received[0] != "3" || received[1] != "1" || received[2] != "2" {
+		t.Errorf("expected every datagram exactly once, got %v", received)
+	}
+}
+
+func TestPacketConnNotAllowed(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	// the server doesn't know this client
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	serverConfig.KeyStore = KeyList{*pub}
+	clientConfig.HandshakeTimeout = 300 * time.Millisecond
+
+	client, server, _ := packetConnPairConfig(t, clientConfig, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	_, err := client.WriteTo([]byte("ping"), server.LocalAddr())
+	if err != os.ErrDeadlineExceeded {
+		t.Errorf("expected the handshake to time out, got %v", err)
+	}
+}
+
+func TestPacketConnForgedHello(t *testing.T) {
+	client, server, hpc := packetConnPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	client.WriteTo([]byte("ping"), server.LocalAddr())
+	_, addr := readPacket(t, server)
+
+	// anyone can send a hello with the client's public key from its address
+	ephemeralPublicKey, _, _ := box.GenerateKey(rand.Reader)
+	forged := append([]byte{datagramHello}, client.newHello(ephemeralPublicKey)...)
+	hpc.PacketConn.WriteTo(forged, server.LocalAddr())
+	time.Sleep(50 * time.Millisecond)
+
+	_, err := server.WriteTo([]byte("pong"), addr)
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if msg, _ := readPacket(t, client); msg != "pong" {
+		t.Errorf("expected %q, got %q", "pong", msg)
+	}
+}
+
+func TestPacketConnRestart(t *testing.T) {
+	client, server, hpc := packetConnPair(t)
+	defer server.Close()
+
+	client.WriteTo([]byte("ping"), server.LocalAddr())
+	readPacket(t, server)
+	addr := hpc.LocalAddr()
+	client.Close()
+
+	// the client comes back on the same address with a new session
+	underlying, err := net.ListenPacket("udp", addr.String())
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	client, err = NewPacketConn(underlying, client.config)
+	if err != nil {
+		t.Fatalf("failed to create packet conn: %v", err)
+	}
+	defer client.Close()
+
+	client.WriteTo([]byte("ping again"), server.LocalAddr())
+	if msg, _ := readPacket(t, server); msg != "ping again" {
+		t.Errorf("expected %q, got %q", "ping again", msg)
+	}
+	_, err = server.WriteTo([]byte("pong"), addr)
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if msg, _ := readPacket(t, client); msg != "pong" {
+		t.Errorf("expected %q, got %q", "pong", msg)
+	}
+}
+
+func TestPacketConnCookie(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	serverConfig.HandshakeTimeout = 100 * time.Millisecond
+	server, err := ListenPacket("udp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer server.Close()
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer peer.Close()
+	exchange := func(datagram []byte) []byte {
+		peer.WriteTo(datagram, server.LocalAddr())
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, maxDatagramSize)
+		n, _, err := peer.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		return buf[:n]
+	}
+	sessions := func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.sessions)
+	}
+
+	ephemeralPublicKey, _, _ := box.GenerateKey(rand.Reader)
+	hello := append([]byte{datagramHello}, (&PacketConn{config: clientConfig}).newHello(ephemeralPublicKey)...)
+
+	// a hello without a cookie only gets a cookie back
+	reply := exchange(hello)
+	if reply[0] != datagramCookie || len(reply) != 1+cookieSize {
+		t.Fatalf("expected a cookie, got %x", reply)
+	}
+	if n := sessions(); n != 0 {
+		t.Errorf("expected no session before the cookie is echoed, got %v", n)
+	}
+
+	reply = exchange(append(hello, reply[1:]...))
+	if reply[0] != datagramHelloReply {
+		t.Fatalf("expected a hello reply, got %x", reply)
+	}
+	if n := sessions(); n != 1 {
+		t.Errorf("expected a session, got %v", n)
+	}
+
+	// we never confirm the handshake
+	time.Sleep(300 * time.Millisecond)
+	if n := sessions(); n != 0 {
+		t.Errorf("expected the unconfirmed session to expire, got %v", n)
+	}
+}
+
+func TestPacketConnMaxSessions(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	server, err := ListenPacket("udp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer server.Close()
+
+	ephemeralPublicKey, _, _ := box.GenerateKey(rand.Reader)
+	hello := (&PacketConn{config: clientConfig}).newHello(ephemeralPublicKey)
+	for i := 0; i < maxPacketSessions; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 5000}
+		if server.answerHello(hello, addr) == nil {
+			t.Fatalf("expected hello %v to be answered", i)
+		}
+	}
+	if server.answerHello(hello, &net.UDPAddr{IP: net.IPv4(10, 1, 0, 0), Port: 5000}) != nil {
+		t.Errorf("expected hellos beyond %v sessions to be dropped", maxPacketSessions)
+	}
+}
+
+func TestPacketConnUnsupportedConfig(t *testing.T) {
+	_, serverConfig := testConfigs()
+	serverConfig.Mode = ModeNoiseXX
+	_, err := ListenPacket("udp", "127.0.0.1:0", serverConfig)
+	if err == nil {
+		t.Errorf("expected Noise modes to be rejected")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, c := range []uint64{1, 5, 3, 70, 64, 100} {
+		if !w.check(c) {
+			t.Errorf("expected %v to be allowed", c)
+		}
+		w.update(c)
+		if w.check(c) {
+			t.Errorf("expected %v to be rejected after it was seen", c)
+		}
+	}
+	// too old
+	if w.check(10) {
+		t.Errorf("expected counters outside the window to be rejected")
+	}
+	if !w.check(99) {
+		t.Errorf("expected unseen counters inside the window to be allowed")
+	}
+}
@@ -0,0 +1,112 @@
+package boxconn
+
+import (
+	"encoding/binary"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Padding selects how written frames are padded to hide their length
+type Padding int
+
+const (
+	// PaddingNone doesn't pad frames
+	PaddingNone Padding = iota
+	// PaddingBlock pads frames to a multiple of Config.PaddingSize
+	PaddingBlock
+	// PaddingPowerOfTwo pads frames to the next power of two
+	PaddingPowerOfTwo
+	// PaddingConstant makes every frame Config.PaddingSize long. Larger
+	// writes are split into several frames.
+	PaddingConstant
+)
+
+// A padded record is sealed like any other record. Inside it carries the
+// actual record type, the length of the data and then the data followed by
+// zeros. The padding is stripped after the record is opened, so it is
+// authenticated along with everything else.
+const paddedHeaderSize = 1 + 1 + 4
+
+// minPaddingFrameSize is the smallest frame size PaddingConstant uses, so
+// there is always room for some data
+const minPaddingFrameSize = 64
+
+// paddedFrameSize returns the size of the frame a record of n bytes is
+// padded to, at most max
+func (c *Config) paddedFrameSize(n, max int) int {
+	var size int
+	switch c.Padding {
+	case PaddingBlock:
+		block := c.paddingSize(DefaultPaddingBlockSize, 1)
+		size = (n + block - 1) / block * block
+	case PaddingPowerOfTwo:
+		size = 1
+		for size < n {
+			size <<= 1
+		}
+	case PaddingConstant:
+		size = c.paddingSize(DefaultPaddingFrameSize, minPaddingFrameSize)
+	default:
+		return n
+	}
+	if size > max {
+		size = max
+	}
+	if size < n {
+		size = n
+	}
+	return size
+}
+
+func (c *Config) paddingSize(def, min int) int {
+	switch {
+	case c.PaddingSize <= 0:
+		return def
+	case c.PaddingSize < min:
+		return min
+	}
+	return c.PaddingSize
+}
+
+// padding returns true if records we write are padded
+func (p *Protocol) padding() bool {
+	return p.config != nil && p.config.Padding != PaddingNone && p.capabilities&capPadding != 0
+}
+
+// paddedRecordSize returns the size of a padded record holding n bytes of
+// data
+func (p *Protocol) paddedRecordSize(n int) int {
+	size := paddedHeaderSize + n
+	return p.config.paddedFrameSize(size+box.Overhead, p.frameLimit()) - box.Overhead
+}
+
+// fillPaddedRecord fills record with a padded record holding data of type
+// typ. The record may be in a reused buffer, so the padding is cleared.
+func fillPaddedRecord(record []byte, typ byte, data []byte) {
+	record[0] = recordPadded
+	record[1] = typ
+	binary.BigEndian.PutUint32(record[2:], uint32(len(data)))
+	n := copy(record[paddedHeaderSize:], data)
+	clearBytes(record[paddedHeaderSize+n:])
+}
+
+// unpadRecord returns the type and data of a padded record. The padding has
+// to be all zeros.
+func unpadRecord(record []byte) (byte, []byte, error) {
+	// the padded record type has already been removed
+	const headerSize = paddedHeaderSize - 1
+	if len(record) < headerSize {
+		return 0, nil, ErrInvalidRecord
+	}
+	typ := record[0]
+	length := binary.BigEndian.Uint32(record[1:])
+	rest := record[headerSize:]
+	if typ == recordPadded || uint64(length) > uint64(len(rest)) {
+		return 0, nil, ErrInvalidRecord
+	}
+	for _, b := range rest[length:] {
+		if b != 0 {
+			return 0, nil, ErrInvalidRecord
+		}
+	}
+	return typ, rest[:length], nil
+}
@@ -0,0 +1,95 @@
+package boxconn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestPaddedFrameSize(t *testing.T) {
+	for _, tc := range []struct {
+		padding      Padding
+		size, n, max int
+		expected     int
+	}{
+		{PaddingNone, 0, 100, 1000, 100},
+		{PaddingBlock, 0, 100, 1000, DefaultPaddingBlockSize},
+		{PaddingBlock, 64, 100, 1000, 128},
+		{PaddingBlock, 64, 128, 1000, 128},
+		{PaddingBlock, 64, 990, 1000, 1000},
+		{PaddingPowerOfTwo, 0, 100, 1000, 128},
+		{PaddingPowerOfTwo, 0, 128, 1000, 128},
+		{PaddingPowerOfTwo, 0, 600, 1000, 1000},
+		{PaddingConstant, 0, 100, 4096, DefaultPaddingFrameSize},
+		{PaddingConstant, 512, 100, 1000, 512},
+		{PaddingConstant, 1, 10, 1000, minPaddingFrameSize},
+		{PaddingConstant, 512, 600, 1000, 600},
+	} {
+		config := &Config{Padding: tc.padding, PaddingSize: tc.size}
+		if got := config.paddedFrameSize(tc.n, tc.max); got != tc.expected {
+			t.Errorf("padding %d size %d: expected %d bytes to be padded to %d, got %d", tc.padding, tc.size, tc.n, tc.expected, got)
+		}
+	}
+}
+
+func TestUnpadRecord(t *testing.T) {
+	typ, data, err := unpadRecord([]byte{recordData, 0, 0, 0, 2, 'h', 'i', 0, 0})
+	if err != nil || typ != recordData || string(data) != "hi" {
+		t.Errorf("expected a data record with %q, got %v %q %v", "hi", typ, data, err)
+	}
+	for _, record := range [][]byte{
+		{recordData, 0, 0},
+		{recordData, 0, 0, 0, 3, 'h', 'i'},
+		{recordData, 0, 0, 0, 2, 'h', 'i', 0, 1},
+		{recordPadded, 0, 0, 0, 0},
+	} {
+		if _, _, err := unpadRecord(record); err != ErrInvalidRecord {
+			t.Errorf("expected ErrInvalidRecord for %v, got %v", record, err)
+		}
+	}
+}
+
+func TestPadding(t *testing.T) {
+	for _, tc := range []struct {
+		padding Padding
+		size    int
+		check   func(size int) bool
+	}{
+		{PaddingBlock, 128, func(size int) bool { return size%128 == 0 }},
+		{PaddingPowerOfTwo, 0, func(size int) bool { return size&(size-1) == 0 }},
+		{PaddingConstant, 256, func(size int) bool { return size == 256 }},
+	} {
+		clientConfig, serverConfig := testConfigs()
+		clientConfig.Padding = tc.padding
+		clientConfig.PaddingSize = tc.size
+		sizes := make(chan int, 100)
+		client, server := handshakePairConfig(t, clientConfig, serverConfig)
+		// only look at frames written after the handshake
+		client.protocol.config = &Config{}
+		*client.protocol.config = *clientConfig
+		client.protocol.config.Tracer = TracerFunc(func(evt Event) {
+			if evt.Type == FrameWritten {
+				sizes <- evt.Size
+			}
+		})
+
+		var data []byte
+		for _, n := range []int{0, 1, 100, 1000} {
+			data = append(data, bytes.Repeat([]byte{'x'}, n)...)
+			client.Write(bytes.Repeat([]byte{'x'}, n))
+		}
+		client.Close()
+		received, err := ioutil.ReadAll(server)
+		if err != nil || !bytes.Equal(received, data) {
+			t.Errorf("padding %d: expected to receive what was written, got %d bytes %v", tc.padding, len(received), err)
+		}
+		server.Close()
+
+		close(sizes)
+		for size := range sizes {
+			if !tc.check(size) {
+				t.Errorf("padding %d: unexpected frame size %d", tc.padding, size)
+			}
+		}
+	}
+}
@@ -3,10 +3,18 @@ package boxconn
 import (
 	"bytes"
 	"code.google.com/p/go-uuid/uuid"
-	"golang.org/x/crypto/nacl/box"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+	"io"
 	"math/rand"
+	"net"
+	"sync"
+	"time"
 )
 
 const (
@@ -15,12 +23,54 @@ const (
 	keySize   = 32
 )
 
+// record types, the first byte of every sealed message
+const (
+	recordData byte = iota
+	recordRekey
+	recordClose
+	recordPadded
+)
+
 type (
+	// Protocol is safe for one goroutine reading and any number of goroutines
+	// writing at the same time. The reading and writing sides have their own
+	// nonce and key, and each is guarded by its own lock.
 	Protocol struct {
-		reader             Reader
-		writer             Writer
-		myNonce, peerNonce [nonceSize]byte
-		privateKey, publicKey, peerKey, sharedKey [keySize]byte
+		readMu, writeMu sync.Mutex
+
+		reader                         Reader
+		writer                         Writer
+		myNonce, peerNonce             [nonceSize]byte
+		privateKey, publicKey, peerKey [keySize]byte
+		peerName                       string
+		sendKey, recvKey               [keySize]byte
+		config                         *Config
+		established                    bool
+
+		// peerAddress is the address we connected to, if we know it.
+		// newHost is set when the peer isn't in Config.KnownHosts yet.
+		peerAddress string
+		newHost     bool
+
+		// noise is set when the session was established with a Noise
+		// handshake. Records are then sealed with ChaChaPoly and the
+		// message counters as nonces.
+		noise                bool
+		sendSeq, recvSeq     uint64
+		sendAEAD, recvAEAD   cipher.AEAD
+		sendNonce, recvNonce [12]byte
+		// opened is the pooled buffer of the last record box opened
+		opened *[]byte
+
+		// what we agreed on with the peer during the handshake
+		version                 byte
+		capabilities            uint32
+		sendFrameSize           int
+		readClosed, writeClosed bool
+
+		// usage of the current send key, see Config.RekeyAfterBytes
+		sentBytes, sentMessages uint64
+		sendKeyCreated          time.Time
 	}
 	Message struct {
 		Nonce [nonceSize]byte
@@ -43,7 +93,10 @@ func (wf WriterFunc) WriteMessage(msg Message) error {
 	return wf(msg)
 }
 
-var zeroNonce [nonceSize]byte
+var (
+	zeroNonce [nonceSize]byte
+	zeroKey   [keySize]byte
+)
 
 // Generate a nonce: timestamp (uuid) + random
 func generateNonce() [nonceSize]byte {
@@ -74,42 +127,82 @@ func NewProtocol(r Reader, w Writer) *Protocol {
 // Handshake establishes a session between two parties. Keys can be generated
 // using box.GenerateKeys. allowedKeys is a list of keys which are allowed
 // for the session.
+//
+// Besides the long-term keys each side generates an ephemeral key pair for
+// the session. The session keys are derived from all three combinations of
+// static and ephemeral keys, so the long-term keys authenticate the session
+// but recorded traffic can't be decrypted with them later.
 func (p *Protocol) Handshake(privateKey, publicKey [keySize]byte, allowedKeys ...[keySize]byte) error {
+	return p.HandshakeConfig(newConfig(privateKey, publicKey, allowedKeys))
+}
+
+// HandshakeConfig is like Handshake but takes its keys and settings from
+// config. config must not be modified afterwards.
+func (p *Protocol) HandshakeConfig(config *Config) error {
+	p.config = config
+	p.trace(Event{Type: HandshakeStart})
+	err := p.handshake(config)
+	if err == nil && p.newHost {
+		err = config.KnownHosts.Add(p.peerAddress, p.peerKey)
+	}
+	p.trace(Event{Type: HandshakeFinish, Err: err})
+	return err
+}
+
+func (p *Protocol) handshake(config *Config) error {
+	if n := len(config.PreSharedKey); n > 0 && n < MinPreSharedKeySize {
+		return ErrPreSharedKeyTooShort
+	}
+	if config.Mode != ModeBox {
+		return p.noiseHandshake(config)
+	}
+
+	privateKey, publicKey := config.PrivateKey, config.PublicKey
 	p.privateKey = privateKey
 	p.publicKey = publicKey
 
-	// write our nonce & public key
-	err := p.WriteRaw(publicKey[:])
+	ephemeralPublicKey, ephemeralPrivateKey, err := box.GenerateKey(crand.Reader)
 	if err != nil {
 		return err
 	}
+	defer clearKey(ephemeralPrivateKey)
 
-	// read the client's nonce & public key
-	data, err := p.ReadRaw()
+	// write our nonce, public key, ephemeral public key & what we support
+	myHello := localHello(config, ephemeralPublicKey)
+	myHello.key = publicKey
+	helloData := myHello.marshal()
+	err = p.WriteRaw(helloData)
 	if err != nil {
 		return err
 	}
-	var peerKey [keySize]byte
-	copy(peerKey[:], data)
+
+	// read the peer's
+	peerHelloData, err := p.ReadRaw()
+	if err != nil {
+		return err
+	}
+	peerHello, err := parseHello(peerHelloData)
+	if err != nil {
+		return err
+	}
+	peerKey, peerEphemeralKey := peerHello.key, peerHello.ephemeralKey
 	p.peerKey = peerKey
-	fmt.Println("PRIVATE KEY:", privateKey)
-	fmt.Println("PEER KEY:", peerKey)
+	err = p.agree(config, myHello, peerHello)
+	if err != nil {
+		return err
+	}
 
 	// verify that this is a key we allow
-	allow := false
-	for _, k := range allowedKeys {
-		if bytes.Equal(k[:], peerKey[:]) {
-			allow = true
-			break
-		}
-	}
-	if !allow {
-		return fmt.Errorf("key not allowed: %x", peerKey[:])
+	err = p.authorize(config, peerKey, peerHello)
+	if err != nil {
+		return err
 	}
 
-	// compute a shared key we can use for the rest of the session
-	box.Precompute(&p.sharedKey, &peerKey, &privateKey)
-	fmt.Println("SHARED KEY:", p.sharedKey)
+	// compute the keys we use for the rest of the session
+	err = p.deriveKeys(helloData, peerHelloData, &privateKey, ephemeralPrivateKey, &peerKey, &peerEphemeralKey, config.PreSharedKey)
+	if err != nil {
+		return err
+	}
 
 	// now to prevent replay attacks we trade session tokens
 	token := []byte(uuid.NewUUID())
@@ -118,8 +211,12 @@ func (p *Protocol) Handshake(privateKey, publicKey [keySize]byte, allowedKeys ..
 		return err
 	}
 
-	// read peer session token
+	// read peer session token. It's the first thing sealed with the
+	// session keys, and the keys only differ if the pre-shared keys do.
 	peerToken, err := p.Read()
+	if err == ErrDecrypt {
+		return ErrPreSharedKeyMismatch
+	}
 	if err != nil {
 		return err
 	}
@@ -137,19 +234,297 @@ func (p *Protocol) Handshake(privateKey, publicKey [keySize]byte, allowedKeys ..
 	}
 
 	if !bytes.Equal(token, receivedToken) {
-		return fmt.Errorf("invalid session token")
+		return ErrInvalidSessionToken
+	}
+
+	p.setEstablished()
+	return nil
+}
+
+// setEstablished marks the handshake as done. It's guarded by writeMu, as
+// Close may check it from another goroutine.
+func (p *Protocol) setEstablished() {
+	p.writeMu.Lock()
+	p.established = true
+	p.writeMu.Unlock()
+}
+
+// isEstablished reports whether the handshake is done
+func (p *Protocol) isEstablished() bool {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.established
+}
+
+// localHello describes what we support, the caller fills in our static key
+func localHello(config *Config, ephemeralKey *[keySize]byte) *hello {
+	h := &hello{
+		ephemeralKey: *ephemeralKey,
+		version:      protocolVersion,
+		capabilities: capRekey | capPadding,
+		maxFrameSize: uint32(config.maxFrameSize()),
+	}
+	if config.Certificate != nil {
+		h.certificate = config.Certificate.Marshal()
+	}
+	return h
+}
+
+// agree settles the version, capabilities and frame size of the session
+func (p *Protocol) agree(config *Config, myHello, peerHello *hello) error {
+	p.version, p.capabilities = negotiate(myHello, peerHello)
+	// we write frames as large as the peer accepts, peers which don't
+	// tell us get what we accept ourselves
+	p.sendFrameSize = config.maxFrameSize()
+	if peerHello.maxFrameSize != 0 {
+		if peerHello.maxFrameSize < MinFrameSize {
+			return ErrInvalidHandshake
+		}
+		p.sendFrameSize = int(peerHello.maxFrameSize)
+	}
+	return nil
+}
+
+// authorize checks the peer's key against the revocations, the KeyStore,
+// the known hosts and, if it sent one, its certificate. peerHello is nil if
+// we haven't got it yet.
+func (p *Protocol) authorize(config *Config, peerKey [keySize]byte, peerHello *hello) error {
+	if config.Revocations != nil && config.Revocations.Revoked(peerKey) {
+		return ErrKeyRevoked
+	}
+	if config.KeyStore != nil {
+		peerName, ok := config.KeyStore.LookupKey(peerKey)
+		if ok {
+			p.peerName = peerName
+			return nil
+		}
+	}
+	if config.KnownHosts != nil && p.peerAddress != "" {
+		known, ok, err := config.KnownHosts.Lookup(p.peerAddress)
+		if err != nil {
+			return err
+		}
+		if ok && known != peerKey {
+			return &KeyChangedError{Address: p.peerAddress, Known: known, Key: peerKey}
+		}
+		// new hosts are only remembered once they've proven they have the
+		// key, see HandshakeConfig
+		p.newHost = !ok
+		p.peerName = p.peerAddress
+		return nil
+	}
+	if peerHello != nil && len(peerHello.certificate) > 0 && len(config.CertificateAuthorities) > 0 {
+		host, err := p.certificateHost(config)
+		if err != nil {
+			return err
+		}
+		cert, err := verifyCertificate(config, peerHello.certificate, peerKey, host)
+		if err != nil {
+			return err
+		}
+		p.peerName = cert.Name
+		return nil
+	}
+	return &KeyNotAllowedError{peerKey}
+}
+
+// certificateHost is the host the peer's certificate has to be valid for.
+// As the initiator that's the host we connected to, otherwise it's us.
+func (p *Protocol) certificateHost(config *Config) (string, error) {
+	if !config.Initiator {
+		return config.hostName()
+	}
+	host, _, err := net.SplitHostPort(p.peerAddress)
+	if err != nil {
+		return p.peerAddress, nil
+	}
+	return host, nil
+}
+
+// frameLimit is the largest sealed record we may write, what's left of the
+// peer's frame size after the frame header
+func (p *Protocol) frameLimit() int {
+	if p.sendFrameSize == 0 {
+		return p.config.maxFrameSize() - frameHeaderSize
+	}
+	return p.sendFrameSize - frameHeaderSize
+}
+
+// maxRecordSize is the largest amount of data which fits in a single
+// sealed record
+func (p *Protocol) maxRecordSize() int {
+	if p.padding() {
+		size := p.frameLimit()
+		if p.config.Padding == PaddingConstant {
+			size = p.config.paddedFrameSize(0, size)
+		}
+		return size - box.Overhead - paddedHeaderSize
+	}
+	return p.frameLimit() - box.Overhead - 1
+}
+
+// deriveKeys computes the send and receive keys for the session
+func (p *Protocol) deriveKeys(hello, peerHello []byte, privateKey, ephemeralPrivateKey, peerKey, peerEphemeralKey *[keySize]byte, psk []byte) error {
+	sendKey, recvKey, err := deriveSessionKeys(hello, peerHello, privateKey, ephemeralPrivateKey, peerKey, peerEphemeralKey, psk)
+	if err != nil {
+		return err
+	}
+	p.sendKey, p.recvKey = sendKey, recvKey
+	p.sendKeyCreated = time.Now()
+	return nil
+}
+
+// deriveSessionKeys computes the send and receive keys for a session from
+// both sides' static and ephemeral keys and the pre-shared key, if there
+// is one. Both sides sort the two hellos the same way so they agree on
+// which key is used in which direction.
+func deriveSessionKeys(hello, peerHello []byte, privateKey, ephemeralPrivateKey, peerKey, peerEphemeralKey *[keySize]byte, psk []byte) (sendKey, recvKey [keySize]byte, err error) {
+	low := bytes.Compare(hello, peerHello) < 0
+
+	// ee, then (low ephemeral, high static), then (low static, high ephemeral)
+	pairs := [][2]*[keySize]byte{
+		{ephemeralPrivateKey, peerEphemeralKey},
+		{ephemeralPrivateKey, peerKey},
+		{privateKey, peerEphemeralKey},
+	}
+	if !low {
+		pairs[1], pairs[2] = [2]*[keySize]byte{privateKey, peerEphemeralKey}, [2]*[keySize]byte{ephemeralPrivateKey, peerKey}
+	}
+	secret := make([]byte, 0, len(pairs)*keySize)
+	for _, pair := range pairs {
+		shared, err := curve25519.X25519(pair[0][:], pair[1][:])
+		if err != nil {
+			return sendKey, recvKey, ErrInvalidHandshake
+		}
+		secret = append(secret, shared...)
+	}
+	// the pre-shared key keeps the session secret even if the DH results
+	// can be computed by an attacker
+	secret = append(secret, psk...)
+	defer clearBytes(secret)
+
+	transcript := sha256.New()
+	if low {
+		transcript.Write(hello)
+		transcript.Write(peerHello)
+	} else {
+		transcript.Write(peerHello)
+		transcript.Write(hello)
 	}
 
+	kdf := hkdf.New(sha256.New, secret, transcript.Sum(nil), []byte("boxconn session keys"))
+	var lowKey, highKey [keySize]byte
+	if _, err := io.ReadFull(kdf, lowKey[:]); err != nil {
+		return sendKey, recvKey, err
+	}
+	if _, err := io.ReadFull(kdf, highKey[:]); err != nil {
+		return sendKey, recvKey, err
+	}
+	if low {
+		return lowKey, highKey, nil
+	}
+	return highKey, lowKey, nil
+}
+
+// nextKey derives the key which replaces key after a rekey
+func nextKey(key *[keySize]byte) error {
+	kdf := hkdf.New(sha256.New, key[:], nil, []byte("boxconn rekey"))
+	_, err := io.ReadFull(kdf, key[:])
+	return err
+}
+
+// nextKey replaces a send or receive key after a rekey. Noise sessions use
+// the Noise rekey function.
+func (p *Protocol) nextKey(key *[keySize]byte) error {
+	if p.noise {
+		noiseRekey(key)
+		p.resetCipher(key)
+		return nil
+	}
+	return nextKey(key)
+}
+
+// rekeyDue returns true if the send key has reached one of its limits
+func (p *Protocol) rekeyDue() bool {
+	if p.config == nil || p.capabilities&capRekey == 0 {
+		return false
+	}
+	if p.sentBytes >= p.config.rekeyAfterBytes() || p.sentMessages >= p.config.rekeyAfterMessages() {
+		return true
+	}
+	d := p.config.rekeyAfterDuration()
+	return d > 0 && time.Since(p.sendKeyCreated) >= d
+}
+
+// rekey tells the peer we're switching keys, then switches to the next
+// send key. The rekey message is sealed with the old key, so it can't be
+// forged.
+func (p *Protocol) rekey() error {
+	err := p.writeRecord(recordRekey, nil)
+	if err != nil {
+		return err
+	}
+	err = p.nextKey(&p.sendKey)
+	if err != nil {
+		return err
+	}
+	p.sentBytes, p.sentMessages = 0, 0
+	p.sendKeyCreated = time.Now()
+	p.trace(Event{Type: Rekey})
 	return nil
 }
 
+// trace sends an event to the configured tracer
+func (p *Protocol) trace(evt Event) {
+	evt.PeerKey = p.peerKey
+	p.config.tracer().Trace(evt)
+}
+
+func clearKey(key *[keySize]byte) {
+	clearBytes(key[:])
+}
+
+func clearBytes(bs []byte) {
+	for i := range bs {
+		bs[i] = 0
+	}
+}
+
 // ReadRaw reads a message from the reader, checks its nonce
-//   value, but does not decrypt it
+// value, but does not decrypt it
 func (p *Protocol) ReadRaw() ([]byte, error) {
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+
+	return p.readRaw()
+}
+
+func (p *Protocol) readRaw() ([]byte, error) {
 	msg, err := p.reader.ReadMessage()
 	if err != nil {
 		return nil, err
 	}
+	return p.checkNonce(msg)
+}
+
+// readFrame is like readRaw, but if the reader can reuse its buffer the data
+// is only valid until the next read
+func (p *Protocol) readFrame() ([]byte, error) {
+	fr, ok := p.reader.(frameReader)
+	if !ok {
+		return p.readRaw()
+	}
+	msg, err := fr.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	return p.checkNonce(msg)
+}
+
+// checkNonce checks that msg has the next nonce we expect from the peer
+func (p *Protocol) checkNonce(msg Message) ([]byte, error) {
+	var err error
+	p.trace(Event{Type: FrameRead, Size: len(msg.Data)})
 	if p.peerNonce == zeroNonce {
 		p.peerNonce = msg.Nonce
 	} else {
@@ -157,61 +532,197 @@ func (p *Protocol) ReadRaw() ([]byte, error) {
 	}
 
 	if !bytes.Equal(msg.Nonce[:], p.peerNonce[:]) {
-		return nil, fmt.Errorf("invalid nonce")
+		err = ErrInvalidNonce
+		p.trace(Event{Type: NonceError, Err: err})
+		return nil, err
 	}
 
-	fmt.Println("READ RAW", msg.Data)
-
 	return msg.Data, nil
 }
 
-// Read reads a raw message from the reader, then decrypts it
+// Read reads a raw message from the reader, then decrypts it. Rekey
+// messages from the peer are handled here and never returned.
+//
+// Read returns io.EOF once the peer has called CloseWrite. If the
+// underlying reader ends before that, ErrTruncated is returned instead.
 func (p *Protocol) Read() ([]byte, error) {
-	sealed, err := p.ReadRaw()
+	data, err := p.read()
 	if err != nil {
 		return nil, err
 	}
+	// the data may be in a buffer the reader or open reuses
+	if _, ok := p.reader.(frameReader); ok || !p.noise {
+		data = append([]byte(nil), data...)
+	}
+	return data, nil
+}
 
-	unsealed, ok := box.Open(nil, sealed, &p.peerNonce, &p.peerKey, &p.privateKey)
-	if !ok {
-		return nil, fmt.Errorf("error decrypting message")
+// read is like Read, but the data is only valid until the next read. It may
+// be in the reader's buffer or in the one open reuses.
+func (p *Protocol) read() ([]byte, error) {
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+
+	if p.readClosed {
+		return nil, io.EOF
+	}
+	for {
+		typ, data, err := p.readRecord()
+		if err != nil {
+			if p.established && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+				err = ErrTruncated
+			}
+			return nil, err
+		}
+		switch typ {
+		case recordData:
+			return data, nil
+		case recordClose:
+			p.readClosed = true
+			return nil, io.EOF
+		case recordRekey:
+			err = p.nextKey(&p.recvKey)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrInvalidRecord
+		}
 	}
+}
 
-	fmt.Println("READ", unsealed)
+// readRecord reads a raw message from the reader, decrypts it and splits
+// it into its record type and data
+func (p *Protocol) readRecord() (byte, []byte, error) {
+	sealed, err := p.readFrame()
+	if err != nil {
+		return 0, nil, err
+	}
 
-	return unsealed, nil
+	unsealed, ok := p.open(sealed)
+	if !ok {
+		err = ErrDecrypt
+		p.trace(Event{Type: DecryptError, Size: len(sealed), Err: err})
+		return 0, nil, err
+	}
+	if len(unsealed) == 0 {
+		return 0, nil, ErrInvalidRecord
+	}
+	if unsealed[0] == recordPadded {
+		return unpadRecord(unsealed[1:])
+	}
+
+	return unsealed[0], unsealed[1:], nil
 }
 
 // WriteRaw writes the data (unsealed) to the writer and increments the nonce
 func (p *Protocol) WriteRaw(data []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	p.nextNonce()
+	return p.writeMessage(data)
+}
+
+// nextNonce moves on to the nonce for the next message we write
+func (p *Protocol) nextNonce() {
 	if p.myNonce == zeroNonce {
 		p.myNonce = generateNonce()
 	} else {
 		p.myNonce = incrementNonce(p.myNonce)
 	}
+}
 
-	fmt.Println("WRITE RAW", data)
-
-	return p.writer.WriteMessage(Message{
+// writeMessage writes data to the writer with the current nonce
+func (p *Protocol) writeMessage(data []byte) error {
+	err := p.writer.WriteMessage(Message{
 		Nonce: p.myNonce,
 		Data:  data,
 	})
+	p.trace(Event{Type: FrameWritten, Size: len(data), Err: err})
+	return err
 }
 
-// Write writes the data (sealed) to the writer and increments the nonce
+// Write writes the data (sealed) to the writer and increments the nonce. If
+// the send key is due to be replaced a rekey message is written first.
 func (p *Protocol) Write(unsealed []byte) error {
-	if p.myNonce == zeroNonce {
-		p.myNonce = generateNonce()
-	} else {
-		p.myNonce = incrementNonce(p.myNonce)
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	if p.writeClosed {
+		return ErrWriteClosed
+	}
+	if p.rekeyDue() {
+		err := p.rekey()
+		if err != nil {
+			return err
+		}
 	}
+	return p.writeRecord(recordData, unsealed)
+}
 
-	sealed := box.Seal(nil, unsealed, &p.myNonce, &p.peerKey, &p.sharedKey)
+// CloseWrite tells the peer we won't write anything else. The peer's Read
+// returns io.EOF once it gets there. Further writes fail.
+func (p *Protocol) CloseWrite() error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
 
-	fmt.Println("WRITE", sealed)
+	if p.writeClosed {
+		return nil
+	}
+	p.writeClosed = true
+	return p.writeRecord(recordClose, nil)
+}
 
-	return p.writer.WriteMessage(Message{
-		Nonce: p.myNonce,
-		Data:  sealed,
-	})
+// writeRecord seals a record and writes it to the writer. If the writer
+// can write a whole frame at once the record is sealed into a pooled buffer
+// with room for the frame header, otherwise the sealed record is handed to
+// WriteMessage.
+func (p *Protocol) writeRecord(typ byte, data []byte) error {
+	p.nextNonce()
+
+	size := 1 + len(data)
+	if p.padding() {
+		size = p.paddedRecordSize(len(data))
+	}
+
+	fw, pooled := p.writer.(frameWriter)
+	var frame []byte
+	if pooled {
+		buf := getBuffer(frameHeaderSize + recordOverhead + size)
+		defer putBuffer(buf)
+		frame = *buf
+	} else {
+		frame = make([]byte, frameHeaderSize+recordOverhead+size)
+	}
+	sealed := frame[frameHeaderSize:]
+	record := sealed[:size]
+	if !p.noise {
+		// box can't seal in place, the record is built in a buffer of its own
+		buf := getBuffer(size)
+		defer putBuffer(buf)
+		record = *buf
+	}
+	if p.padding() {
+		fillPaddedRecord(record, typ, data)
+	} else {
+		record[0] = typ
+		copy(record[1:], data)
+	}
+	p.seal(sealed, record)
+
+	p.sentBytes += uint64(len(data))
+	p.sentMessages++
+
+	var err error
+	if pooled {
+		err = fw.writeFrame(&p.myNonce, frame)
+	} else {
+		err = p.writer.WriteMessage(Message{
+			Nonce: p.myNonce,
+			Data:  sealed,
+		})
+	}
+	p.trace(Event{Type: FrameWritten, Size: len(sealed), Err: err})
+	return err
 }
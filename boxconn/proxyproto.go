@@ -0,0 +1,197 @@
+package boxconn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxProxyHeaderV1Size is the longest version 1 header allowed by the
+	// spec, including the CRLF
+	maxProxyHeaderV1Size = 107
+	// maxProxyHeaderV2Size limits the addresses and TLVs of a version 2
+	// header we're willing to read
+	maxProxyHeaderV2Size = 4096
+)
+
+var (
+	proxyHeaderV1Prefix  = []byte("PROXY ")
+	proxyHeaderSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+type (
+	// proxyConn is a connection from a load balancer whose RemoteAddr is the
+	// client address from its PROXY header
+	proxyConn struct {
+		net.Conn
+		remoteAddr net.Addr
+	}
+)
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// CloseWrite shuts down the writing side of the underlying connection if it
+// supports it
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// trustsProxy returns true if addr is one of TrustedProxies
+func (c *Config) trustsProxy(addr net.Addr) bool {
+	if len(c.TrustedProxies) == 0 {
+		return false
+	}
+	ip := net.ParseIP(remoteIP(addr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a PROXY protocol header from conn and returns conn
+// with the client address from the header as its RemoteAddr. Headers which
+// don't carry an address, like health checks by the proxy itself, leave
+// RemoteAddr alone. Nothing after the header is read.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	// both versions start with at least 6 bytes we can tell apart
+	start := make([]byte, len(proxyHeaderV1Prefix))
+	if _, err := io.ReadFull(conn, start); err != nil {
+		return nil, err
+	}
+
+	var addr net.Addr
+	var err error
+	switch {
+	case bytes.Equal(start, proxyHeaderV1Prefix):
+		addr, err = readProxyHeaderV1(conn)
+	case bytes.Equal(start, proxyHeaderSignature[:len(start)]):
+		addr, err = readProxyHeaderV2(conn)
+	default:
+		err = ErrInvalidProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, remoteAddr: addr}, nil
+}
+
+// readProxyHeaderV1 reads the rest of a version 1 header, a line like:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+//
+// The line has no length prefix, so it's read a byte at a time so that
+// nothing after it is consumed.
+func readProxyHeaderV1(r io.Reader) (net.Addr, error) {
+	line := make([]byte, 0, maxProxyHeaderV1Size)
+	b := make([]byte, 1)
+	for {
+		if len(line) >= maxProxyHeaderV1Size-len(proxyHeaderV1Prefix) {
+			return nil, ErrInvalidProxyHeader
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[1])
+	if ip == nil || (ip.To4() != nil) != (fields[0] == "TCP4") || net.ParseIP(fields[2]) == nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	if _, err := strconv.ParseUint(fields[4], 10, 16); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads the rest of a binary version 2 header:
+//
+//	signature [12]byte
+//	version and command byte
+//	address family and protocol byte
+//	length uint16
+//	addresses and TLVs [length]byte
+func readProxyHeaderV2(r io.Reader) (net.Addr, error) {
+	const start = len("PROXY ")
+	header := make([]byte, 16)
+	copy(header, proxyHeaderSignature[:start])
+	if _, err := io.ReadFull(r, header[start:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyHeaderSignature) || header[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+	command, family := header[12]&0xf, header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	if length > maxProxyHeaderV2Size {
+		return nil, ErrInvalidProxyHeader
+	}
+	rest := make([]byte, length)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0:
+		// LOCAL, a connection made by the proxy itself
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+
+	var ipSize int
+	switch family >> 4 {
+	case 1:
+		ipSize = net.IPv4len
+	case 2:
+		ipSize = net.IPv6len
+	default:
+		// unspecified or unix sockets, there's no address to report
+		return nil, nil
+	}
+	if len(rest) < 2*ipSize+4 {
+		return nil, ErrInvalidProxyHeader
+	}
+	ip := make(net.IP, ipSize)
+	copy(ip, rest)
+	port := binary.BigEndian.Uint16(rest[2*ipSize:])
+	if family&0xf == 2 {
+		return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,200 @@
+package boxconn
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, addrs ...byte) string {
+		header := append([]byte{}, proxyHeaderSignature...)
+		header = append(header, 0x20|command, family, byte(len(addrs)>>8), byte(len(addrs)))
+		return string(append(header, addrs...))
+	}
+	v4Addrs := []byte{
+		192, 0, 2, 1, 198, 51, 100, 1, // source and destination
+		0xdc, 0x04, 0x01, 0xbb, // 56324 and 443
+	}
+	v6Addrs := append([]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1, 16 + 15: 2}, 0xdc, 0x04, 0x01, 0xbb)
+
+	for _, test := range []struct {
+		header   string
+		expected string
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324"},
+		{"PROXY UNKNOWN\r\n", "127.0.0.1"},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", "127.0.0.1"},
+		{v2(1, 0x11, v4Addrs...), "192.0.2.1:56324"},
+		{v2(1, 0x21, v6Addrs...), "[2001:db8::1]:56324"},
+		// TLVs after the addresses are skipped
+		{v2(1, 0x11, append(v4Addrs, 0x04, 0x00, 0x01, 0xff)...), "192.0.2.1:56324"},
+		// LOCAL and unspecified keep the proxy's address
+		{v2(0, 0x11, v4Addrs...), "127.0.0.1"},
+		{v2(1, 0x00), "127.0.0.1"},
+		// errors
+		{"GET / HTTP/1.1\r\n", ""},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", ""},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n", ""},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", ""},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443 " + string(make([]byte, 100)) + "\r\n", ""},
+		{v2(2, 0x11, v4Addrs...), ""},
+		{v2(1, 0x11, v4Addrs[:8]...), ""},
+	} {
+		c1, c2 := tcpPipe(t)
+		go func() {
+			c1.Write([]byte(test.header + "after"))
+			c1.Close()
+		}()
+
+		conn, err := readProxyHeader(c2)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.header)
+			}
+			c2.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.header, err)
+			c2.Close()
+			continue
+		}
+		addr := conn.RemoteAddr().String()
+		if test.expected == "127.0.0.1" {
+			addr = remoteIP(conn.RemoteAddr())
+		}
+		if addr != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.header, test.expected, addr)
+		}
+		// nothing after the header is consumed
+		if rest, _ := ioutil.ReadAll(conn); string(rest) != "after" {
+			t.Errorf("%q: expected the data after the header to be left, got %q", test.header, rest)
+		}
+		c2.Close()
+	}
+}
+
+func TestListenerProxyProtocol(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	serverConfig.TrustedProxies = []*net.IPNet{loopback}
+	failed := make(chan error, 1)
+	serverConfig.HandshakeFailed = func(addr net.Addr, err error) {
+		failed <- err
+	}
+
+	l, err := ListenConfig("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	go HandshakeConfig(conn, clientConfig)
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer c.Close()
+	if c.RemoteAddr().String() != "192.0.2.1:56324" {
+		t.Errorf("expected the client address from the header, got %v", c.RemoteAddr())
+	}
+
+	// trusted proxies have to send a header
+	if _, err := DialConfig("tcp", l.Addr().String(), clientConfig); err == nil {
+		t.Errorf("expected a client without a header to fail")
+	}
+	if err := <-failed; err != ErrInvalidProxyHeader {
+		t.Errorf("expected ErrInvalidProxyHeader, got %v", err)
+	}
+}
+
+func TestListenerProxyHealthChecks(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	serverConfig.TrustedProxies = []*net.IPNet{loopback}
+	serverConfig.MaxHandshakeFailures = 2
+	failed := make(chan error, 10)
+	serverConfig.HandshakeFailed = func(addr net.Addr, err error) {
+		failed <- err
+	}
+
+	l, err := ListenConfig("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	dial := func(header string) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(header))
+	}
+
+	// health checks which hang up after the header fail the handshake,
+	// but don't get the balancer banned
+	local := string(proxyHeaderSignature) + "\x20\x00\x00\x00"
+	for i := 0; i < 5; i++ {
+		dial(local)
+		dial("PROXY UNKNOWN\r\n")
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-failed; err == ErrBanned {
+			t.Fatalf("expected health checks not to get the balancer banned")
+		}
+	}
+
+	// a health check which goes through with the handshake succeeds
+	for _, header := range []string{local, "PROXY UNKNOWN\r\n"} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		conn.Write([]byte(header))
+		go HandshakeConfig(conn, clientConfig)
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatalf("failed to accept after %q: %v", header, err)
+		}
+		if ip := remoteIP(c.RemoteAddr()); ip != "127.0.0.1" {
+			t.Errorf("expected the balancer's address, got %v", c.RemoteAddr())
+		}
+		c.Close()
+		conn.Close()
+	}
+
+	// failures from a trusted address aren't counted either
+	for i := 0; i < 5; i++ {
+		dial("PROXY TCP4 127.0.0.2 127.0.0.1 56324 443\r\n")
+		if err := <-failed; err == ErrBanned {
+			t.Fatalf("expected a trusted address not to be banned")
+		}
+	}
+	if bans := l.Bans(); len(bans) != 0 {
+		t.Fatalf("expected the balancer not to be banned, got %v", bans)
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	go HandshakeConfig(conn, clientConfig)
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	c.Close()
+}
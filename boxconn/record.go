@@ -0,0 +1,130 @@
+package boxconn
+
+import (
+	"encoding/binary"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/box"
+	"math/bits"
+	"sync"
+)
+
+const (
+	// frameHeaderSize is the nonce and length in front of every frame
+	frameHeaderSize = nonceSize + lenSize
+	// recordOverhead is what sealing adds to a record. It's the same for
+	// box and ChaChaPoly.
+	recordOverhead = box.Overhead
+
+	// buffers are pooled in power of two sizes between these
+	minPooledBufferBits = 9
+	maxPooledBufferBits = 24
+)
+
+type (
+	// frameReader is implemented by readers which can hand out frames in a
+	// buffer they reuse. The data is only valid until the next call.
+	frameReader interface {
+		readFrame() (Message, error)
+	}
+	// frameWriter is implemented by writers which can write a frame in one
+	// go. frame has frameHeaderSize bytes of room for the header in front of
+	// the data.
+	frameWriter interface {
+		writeFrame(nonce *[nonceSize]byte, frame []byte) error
+	}
+)
+
+var bufferPools [maxPooledBufferBits + 1]sync.Pool
+
+// getBuffer returns a buffer of length size. Unless it's very large it
+// comes from a pool and should be given back with putBuffer.
+func getBuffer(size int) *[]byte {
+	class := bufferClass(size)
+	if class > maxPooledBufferBits {
+		b := make([]byte, size)
+		return &b
+	}
+	if v := bufferPools[class].Get(); v != nil {
+		b := v.(*[]byte)
+		*b = (*b)[:size]
+		return b
+	}
+	b := make([]byte, size, 1<<uint(class))
+	return &b
+}
+
+// putBuffer returns a buffer from getBuffer to its pool. Nothing may use it
+// afterwards.
+func putBuffer(b *[]byte) {
+	class := bufferClass(cap(*b))
+	if class > maxPooledBufferBits || cap(*b) != 1<<uint(class) {
+		return
+	}
+	bufferPools[class].Put(b)
+}
+
+// bufferClass returns the pool for buffers of size
+func bufferClass(size int) int {
+	if size <= 1<<minPooledBufferBits {
+		return minPooledBufferBits
+	}
+	return bits.Len(uint(size - 1))
+}
+
+// seal encrypts record into sealed, which is recordOverhead bytes longer.
+// ChaChaPoly seals in place, record may be the start of sealed. Box can't,
+// so record has to be a buffer of its own.
+func (p *Protocol) seal(sealed, record []byte) {
+	if p.noise {
+		if p.sendAEAD == nil {
+			p.sendAEAD, _ = chacha20poly1305.New(p.sendKey[:])
+		}
+		binary.LittleEndian.PutUint64(p.sendNonce[4:], p.sendSeq)
+		p.sendAEAD.Seal(sealed[:0], p.sendNonce[:], record, nil)
+		p.sendSeq++
+		return
+	}
+	box.SealAfterPrecomputation(sealed[:0], record, &p.myNonce, &p.sendKey)
+}
+
+// open decrypts a sealed record and returns the record. ChaChaPoly opens in
+// place, box opens into a pooled buffer which is reused by the next open.
+func (p *Protocol) open(sealed []byte) ([]byte, bool) {
+	if len(sealed) < recordOverhead {
+		return nil, false
+	}
+	if p.noise {
+		if p.recvAEAD == nil {
+			p.recvAEAD, _ = chacha20poly1305.New(p.recvKey[:])
+		}
+		binary.LittleEndian.PutUint64(p.recvNonce[4:], p.recvSeq)
+		unsealed, err := p.recvAEAD.Open(sealed[:0], p.recvNonce[:], sealed, nil)
+		if err != nil {
+			return nil, false
+		}
+		p.recvSeq++
+		return unsealed, true
+	}
+	p.releaseOpened()
+	p.opened = getBuffer(len(sealed) - box.Overhead)
+	return box.OpenAfterPrecomputation((*p.opened)[:0], sealed, &p.peerNonce, &p.recvKey)
+}
+
+// releaseOpened gives the buffer of the last record box opened back to the
+// pool. The record may not be used afterwards.
+func (p *Protocol) releaseOpened() {
+	if p.opened != nil {
+		putBuffer(p.opened)
+		p.opened = nil
+	}
+}
+
+// resetCipher forgets the ChaChaPoly cipher of the send or receive key
+// after it changes
+func (p *Protocol) resetCipher(key *[keySize]byte) {
+	if key == &p.sendKey {
+		p.sendAEAD = nil
+	} else {
+		p.recvAEAD = nil
+	}
+}
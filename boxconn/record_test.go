@@ -0,0 +1,184 @@
+package boxconn
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	for _, test := range []struct {
+		size, capacity int
+	}{
+		{0, 512},
+		{512, 512},
+		{513, 1024},
+		// the largest frame, header included, fits its class
+		{DefaultMaxFrameSize, DefaultMaxFrameSize},
+		{DefaultMaxFrameSize + 1, 2 * DefaultMaxFrameSize},
+		{1<<maxPooledBufferBits + 1, 1<<maxPooledBufferBits + 1},
+	} {
+		buf := getBuffer(test.size)
+		if len(*buf) != test.size || cap(*buf) != test.capacity {
+			t.Errorf("%d: expected a buffer of capacity %d, got %d", test.size, test.capacity, cap(*buf))
+		}
+		putBuffer(buf)
+	}
+}
+
+func benchmarkConn(b *testing.B, mode Mode, size int) {
+	clientConfig, serverConfig := testConfigs()
+	clientConfig.Mode, serverConfig.Mode = mode, mode
+	clientConfig.Initiator = true
+	client, server := handshakePairConfig(b, clientConfig, serverConfig)
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, server)
+		close(done)
+	}()
+
+	data := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(data); err != nil {
+			b.Fatalf("failed to write: %v", err)
+		}
+	}
+	client.CloseWrite()
+	<-done
+	b.StopTimer()
+	client.Close()
+}
+
+// BenchmarkConn writes to a Conn while the other end reads everything. The
+// allocations of both ends are counted.
+func BenchmarkConn(b *testing.B) {
+	for _, mode := range []struct {
+		name string
+		mode Mode
+	}{
+		{"Box", ModeBox},
+		{"Noise", ModeNoiseXX},
+	} {
+		for _, size := range []struct {
+			name string
+			size int
+		}{
+			{"64", 64},
+			{"1K", 1 << 10},
+			{"16K", 16 << 10},
+			{"64K", 64 << 10},
+		} {
+			b.Run(mode.name+"/"+size.name, func(b *testing.B) {
+				benchmarkConn(b, mode.mode, size.size)
+			})
+		}
+	}
+}
+
+// discardConn throws away everything written to it
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// frameSource reads from a buffer, which refill fills up whenever it's
+// empty
+type frameSource struct {
+	net.Conn
+	buf    bytes.Buffer
+	refill func()
+}
+
+func (fs *frameSource) Read(b []byte) (int, error) {
+	if fs.buf.Len() == 0 {
+		fs.refill()
+	}
+	return fs.buf.Read(b)
+}
+
+func (fs *frameSource) Write(b []byte) (int, error) {
+	return fs.buf.Write(b)
+}
+
+// benchmarkModes runs fn for both kinds of session and a few write sizes
+func benchmarkModes(b *testing.B, fn func(b *testing.B, client, server *Conn, size int)) {
+	for _, mode := range []struct {
+		name string
+		mode Mode
+	}{
+		{"Box", ModeBox},
+		{"Noise", ModeNoiseXX},
+	} {
+		for _, size := range []struct {
+			name string
+			size int
+		}{
+			{"64", 64},
+			{"1K", 1 << 10},
+			{"16K", 16 << 10},
+		} {
+			b.Run(mode.name+"/"+size.name, func(b *testing.B) {
+				clientConfig, serverConfig := testConfigs()
+				clientConfig.Mode, serverConfig.Mode = mode.mode, mode.mode
+				clientConfig.Initiator = true
+				client, server := handshakePairConfig(b, clientConfig, serverConfig)
+				// the benchmarks replace the underlying connections
+				defer client.underlying.Close()
+				defer server.underlying.Close()
+
+				b.SetBytes(int64(size.size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				fn(b, client, server, size.size)
+			})
+		}
+	}
+}
+
+// BenchmarkConnWrite counts what writing costs on its own, the frames go
+// nowhere
+func BenchmarkConnWrite(b *testing.B) {
+	benchmarkModes(b, func(b *testing.B, client, server *Conn, size int) {
+		client.underlying = discardConn{client.underlying}
+		data := make([]byte, size)
+		for i := 0; i < b.N; i++ {
+			if _, err := client.Write(data); err != nil {
+				b.Fatalf("failed to write: %v", err)
+			}
+		}
+	})
+}
+
+// BenchmarkConnRead counts what reading costs on its own. The frames are
+// written while the timer is stopped.
+func BenchmarkConnRead(b *testing.B) {
+	benchmarkModes(b, func(b *testing.B, client, server *Conn, size int) {
+		data := make([]byte, size)
+		src := &frameSource{Conn: server.underlying}
+		src.refill = func() {
+			b.StopTimer()
+			for i := 0; i < 64; i++ {
+				client.Write(data)
+			}
+			b.StartTimer()
+		}
+		client.underlying = src
+		server.underlying = src
+		buf := make([]byte, size)
+		for i := 0; i < b.N; i++ {
+			if _, err := io.ReadFull(server, buf); err != nil {
+				b.Fatalf("failed to read: %v", err)
+			}
+		}
+	})
+}
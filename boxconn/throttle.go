@@ -0,0 +1,164 @@
+package boxconn
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Ban describes a remote IP which a Listener refuses connections from
+	// because too many of its handshakes failed
+	Ban struct {
+		IP string
+		// Until is when the ban ends
+		Until time.Time
+		// Count is the number of times the IP has been banned in a row.
+		// Every ban lasts twice as long as the one before.
+		Count int
+	}
+
+	// throttle tracks handshake failures per remote IP
+	throttle struct {
+		config *Config
+
+		mu        sync.Mutex
+		entries   map[string]*throttleEntry
+		lastPrune time.Time
+	}
+	throttleEntry struct {
+		// failures since windowStart
+		failures    int
+		windowStart time.Time
+		// bans in a row and when the current one ends
+		bans        int
+		bannedUntil time.Time
+		lastFailure time.Time
+	}
+)
+
+func newThrottle(config *Config) *throttle {
+	return &throttle{
+		config:  config,
+		entries: make(map[string]*throttleEntry),
+	}
+}
+
+// remoteIP returns the IP part of addr, or the whole address if it doesn't
+// have one
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// banned returns true if ip is currently banned
+func (t *throttle) banned(ip string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[ip]
+	return ok && now.Before(e.bannedUntil)
+}
+
+// fail records a failed handshake from ip and returns true if ip is now
+// banned
+func (t *throttle) fail(ip string, now time.Time) bool {
+	max := t.config.maxHandshakeFailures()
+	if max <= 0 {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(now)
+
+	e, ok := t.entries[ip]
+	if !ok {
+		e = &throttleEntry{}
+		t.entries[ip] = e
+	}
+	if now.Sub(e.windowStart) > t.config.handshakeFailureWindow() {
+		e.failures, e.windowStart = 0, now
+	}
+	e.failures++
+	e.lastFailure = now
+	if e.failures < max {
+		return false
+	}
+
+	// ban, twice as long as last time
+	d := t.config.banDuration()
+	for i := 0; i < e.bans && d < t.config.maxBanDuration(); i++ {
+		d *= 2
+	}
+	if d > t.config.maxBanDuration() {
+		d = t.config.maxBanDuration()
+	}
+	e.bans++
+	e.bannedUntil = now.Add(d)
+	e.failures, e.windowStart = 0, now
+	return true
+}
+
+// succeed records a successful handshake from ip. Failures so far are
+// forgiven, but the ban count is kept so a client which keeps failing
+// still backs off.
+func (t *throttle) succeed(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.entries[ip]; ok {
+		e.failures = 0
+	}
+}
+
+// prune forgets IPs which haven't failed for the maximum ban duration. It
+// only does the work once per failure window. mu must be held.
+func (t *throttle) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < t.config.handshakeFailureWindow() {
+		return
+	}
+	t.lastPrune = now
+	forget := t.config.maxBanDuration()
+	if w := t.config.handshakeFailureWindow(); w > forget {
+		forget = w
+	}
+	for ip, e := range t.entries {
+		if now.After(e.bannedUntil) && now.Sub(e.lastFailure) > forget {
+			delete(t.entries, ip)
+		}
+	}
+}
+
+// bans returns the current bans, the ones ending first first
+func (t *throttle) bans(now time.Time) []Ban {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var bans []Ban
+	for ip, e := range t.entries {
+		if now.Before(e.bannedUntil) {
+			bans = append(bans, Ban{IP: ip, Until: e.bannedUntil, Count: e.bans})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+// unban lifts the ban on ip and forgets its failures
+func (t *throttle) unban(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.entries, ip)
+}
@@ -0,0 +1,127 @@
+package boxconn
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(&Config{
+		MaxHandshakeFailures:   3,
+		HandshakeFailureWindow: time.Minute,
+		BanDuration:            time.Minute,
+		MaxBanDuration:         3 * time.Minute,
+	})
+	now := time.Date(2015, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	// failures outside the window don't add up
+	th.fail("1.2.3.4", now)
+	th.fail("1.2.3.4", now.Add(30*time.Second))
+	now = now.Add(2 * time.Minute)
+	if th.fail("1.2.3.4", now) || th.banned("1.2.3.4", now) {
+		t.Fatalf("expected old failures to be forgotten")
+	}
+
+	// a success forgives failures
+	th.fail("1.2.3.4", now)
+	th.succeed("1.2.3.4")
+	if th.fail("1.2.3.4", now) {
+		t.Fatalf("expected failures to be forgiven after a success")
+	}
+
+	// each ban lasts twice as long as the last, up to the maximum
+	for i, expected := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		th.fail("1.2.3.4", now)
+		if !th.fail("1.2.3.4", now) && !th.fail("1.2.3.4", now) {
+			t.Fatalf("ban %d: expected 1.2.3.4 to be banned", i)
+		}
+		if !th.banned("1.2.3.4", now) || th.banned("5.6.7.8", now) {
+			t.Fatalf("ban %d: expected only 1.2.3.4 to be banned", i)
+		}
+		bans := th.bans(now)
+		if len(bans) != 1 || bans[0].IP != "1.2.3.4" || bans[0].Count != i+1 || !bans[0].Until.Equal(now.Add(expected)) {
+			t.Fatalf("ban %d: expected a ban for %v, got %v", i, expected, bans)
+		}
+		now = now.Add(expected)
+		if th.banned("1.2.3.4", now.Add(time.Second)) {
+			t.Fatalf("ban %d: expected the ban to end", i)
+		}
+	}
+
+	// quiet IPs are forgotten eventually
+	now = now.Add(time.Hour)
+	th.fail("5.6.7.8", now)
+	if _, ok := th.entries["1.2.3.4"]; ok {
+		t.Errorf("expected 1.2.3.4 to be forgotten")
+	}
+
+	th.unban("5.6.7.8")
+	if len(th.entries) != 0 {
+		t.Errorf("expected unban to forget 5.6.7.8")
+	}
+
+	// negative disables bans
+	th = newThrottle(&Config{MaxHandshakeFailures: -1})
+	for i := 0; i < 100; i++ {
+		if th.fail("1.2.3.4", now) {
+			t.Fatalf("expected bans to be disabled")
+		}
+	}
+}
+
+func TestListenerBans(t *testing.T) {
+	clientConfig, serverConfig := testConfigs()
+	serverConfig.MaxHandshakeFailures = 2
+	failed := make(chan error, 10)
+	serverConfig.HandshakeFailed = func(addr net.Addr, err error) {
+		failed <- err
+	}
+
+	l, err := ListenConfig("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	// clients which hang up right away
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		conn.Close()
+		if err := <-failed; err == ErrBanned {
+			t.Fatalf("didn't expect a ban yet")
+		}
+	}
+
+	bans := l.Bans()
+	if len(bans) != 1 || bans[0].IP != "127.0.0.1" || bans[0].Count != 1 {
+		t.Fatalf("expected 127.0.0.1 to be banned, got %v", bans)
+	}
+
+	// even a good client is turned away now
+	if _, err := DialConfig("tcp", l.Addr().String(), clientConfig); err == nil {
+		t.Errorf("expected a banned client to fail")
+	}
+	if err := <-failed; err != ErrBanned {
+		t.Errorf("expected ErrBanned, got %v", err)
+	}
+
+	l.Unban("127.0.0.1")
+	if len(l.Bans()) != 0 {
+		t.Fatalf("expected the ban to be lifted")
+	}
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := DialConfig("tcp", l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatalf("expected the client to connect after the ban was lifted, got %v", err)
+	}
+	c.Close()
+}
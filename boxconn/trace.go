@@ -0,0 +1,104 @@
+package boxconn
+
+import (
+	"encoding/hex"
+	"log"
+)
+
+// EventType is the kind of a trace Event
+type EventType int
+
+const (
+	// HandshakeStart is traced when a handshake begins
+	HandshakeStart EventType = iota
+	// HandshakeFinish is traced when a handshake ends. Err is set if it
+	// failed.
+	HandshakeFinish
+	// FrameRead is traced for every frame read. Size is the size of the
+	// frame on the wire.
+	FrameRead
+	// FrameWritten is traced for every frame written. Size is the size of
+	// the frame on the wire.
+	FrameWritten
+	// Rekey is traced when we replace our send key
+	Rekey
+	// NonceError is traced when a frame arrives with an unexpected nonce
+	NonceError
+	// DecryptError is traced when a frame fails to decrypt
+	DecryptError
+)
+
+var eventTypeNames = map[EventType]string{
+	HandshakeStart:  "handshake-start",
+	HandshakeFinish: "handshake-finish",
+	FrameRead:       "frame-read",
+	FrameWritten:    "frame-written",
+	Rekey:           "rekey",
+	NonceError:      "nonce-error",
+	DecryptError:    "decrypt-error",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+type (
+	// Event describes something that happened in a session. Events never
+	// contain key material other than the peer's public key, or any of the
+	// data sent over the connection.
+	Event struct {
+		Type EventType
+		// PeerKey is the peer's public key, it is zero until the peer's
+		// hello has been read
+		PeerKey [keySize]byte
+		// Size is the size of a frame
+		Size int
+		// Err is the error which caused the event, if any
+		Err error
+	}
+
+	// A Tracer receives events from a session. Trace is called from the
+	// goroutine doing the reading or writing, so it should be fast.
+	Tracer interface {
+		Trace(Event)
+	}
+	// TracerFunc adapts an ordinary function to a Tracer
+	TracerFunc func(Event)
+
+	nopTracer struct{}
+	logTracer struct {
+		logger *log.Logger
+	}
+)
+
+// Trace calls tf(evt)
+func (tf TracerFunc) Trace(evt Event) {
+	tf(evt)
+}
+
+func (nopTracer) Trace(Event) {}
+
+// NopTracer is a Tracer which ignores every event. It is used when
+// Config.Tracer is nil.
+var NopTracer Tracer = nopTracer{}
+
+// NewLogTracer returns a Tracer which writes every event to logger
+func NewLogTracer(logger *log.Logger) Tracer {
+	return logTracer{logger}
+}
+
+func (lt logTracer) Trace(evt Event) {
+	peer := "unknown"
+	if evt.PeerKey != zeroKey {
+		peer = hex.EncodeToString(evt.PeerKey[:8])
+	}
+	switch {
+	case evt.Err != nil:
+		lt.logger.Printf("[boxconn] %v peer=%v size=%d err=%v\n", evt.Type, peer, evt.Size, evt.Err)
+	default:
+		lt.logger.Printf("[boxconn] %v peer=%v size=%d\n", evt.Type, peer, evt.Size)
+	}
+}
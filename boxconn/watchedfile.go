@@ -0,0 +1,80 @@
+package boxconn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+type (
+	// watchedFile is a file which is parsed again whenever it changes. It
+	// has no lock of its own, the type it belongs to guards it.
+	watchedFile struct {
+		path string
+		// parse is called with the contents of the file whenever it
+		// changed. If it fails the file is parsed again next time.
+		parse func(r io.Reader) error
+
+		loaded  bool
+		modTime time.Time
+		size    int64
+	}
+)
+
+// reloadIfChanged parses the file if it changed since it was last parsed
+func (wf *watchedFile) reloadIfChanged() error {
+	fi, err := os.Stat(wf.path)
+	if err != nil {
+		wf.loaded = false
+		return err
+	}
+	if wf.loaded && fi.ModTime().Equal(wf.modTime) && fi.Size() == wf.size {
+		return nil
+	}
+
+	f, err := os.Open(wf.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = wf.parse(f)
+	if err != nil {
+		return err
+	}
+	wf.loaded = true
+	wf.modTime = fi.ModTime()
+	wf.size = fi.Size()
+	return nil
+}
+
+// invalidate makes sure the file is parsed again next time, after we've
+// written to it ourselves
+func (wf *watchedFile) invalidate() {
+	wf.loaded = false
+}
+
+// ParseLines calls fn with the whitespace separated fields of every line in
+// r which isn't empty. Everything after a # is a comment. Errors from fn get
+// the line number. It reads the authorized keys, known hosts and revocation
+// files, and is handy for other files in the same style.
+func ParseLines(r io.Reader, fn func(fields []string) error) error {
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := fn(fields); err != nil {
+			return fmt.Errorf("line %d: %v", lineno, err)
+		}
+	}
+	return scanner.Err()
+}
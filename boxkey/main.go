@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/badgerodon/net/boxconn"
+)
+
+const usage = `usage: boxkey <command> [arguments]
+
+commands:
+    generate [-o file] [-name name] [-f]   generate a new keypair
+    public <private key file>              print the public key line
+    fingerprint <key file>                 print the fingerprint of a key
+`
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "generate":
+		err = generate(args)
+	case "public":
+		err = public(args)
+	case "fingerprint":
+		err = fingerprint(args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func generate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	out := fs.String("o", "boxconn.key", "file to write the private key to, the public key goes to <file>.pub")
+	name := fs.String("name", "", "name to put on the public key line")
+	force := fs.Bool("f", false, "overwrite existing files")
+	fs.Parse(args)
+
+	if !*force {
+		for _, path := range []string{*out, *out + ".pub"} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists, use -f to overwrite it", path)
+			}
+		}
+	}
+
+	priv, pub, err := boxconn.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	// check the name before anything is written
+	if _, err := boxconn.MarshalPublicKey(pub, *name); err != nil {
+		return err
+	}
+	if err := boxconn.WritePrivateKeyFile(*out, priv); err != nil {
+		return err
+	}
+	if err := boxconn.WritePublicKeyFile(*out+".pub", pub, *name); err != nil {
+		return err
+	}
+	fmt.Println("private key:", *out)
+	fmt.Println("public key: ", *out+".pub")
+	fmt.Println("fingerprint:", boxconn.Fingerprint(pub))
+	return nil
+}
+
+func public(args []string) error {
+	fs := flag.NewFlagSet("public", flag.ExitOnError)
+	name := fs.String("name", "", "name to put on the public key line")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a private key file")
+	}
+
+	_, pub, err := boxconn.LoadPrivateKeyFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	line, err := boxconn.MarshalPublicKey(pub, *name)
+	if err != nil {
+		return err
+	}
+	fmt.Println(line)
+	return nil
+}
+
+func fingerprint(args []string) error {
+	fs := flag.NewFlagSet("fingerprint", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a key file")
+	}
+
+	// either a private key file or a public key line
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var pub [32]byte
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "-----BEGIN") {
+		_, pub, err = boxconn.LoadPrivateKeyFile(fs.Arg(0))
+	} else {
+		pub, _, err = boxconn.ParsePublicKey(string(data))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(boxconn.Fingerprint(pub))
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/badgerodon/net/boxconn"
+)
+
+type (
+	// rule is a single forward from the config file:
+	//
+	//     # client <local address> <server address> <server public key>
+	//     client 127.0.0.1:5432 db.example.com:7000 8VBo1sPMIoR8VxB2oKgDs4v7tTFXGSpJ1xdn7DdOGR4=
+	//     # server <listen address> <target address>
+	//     server :7000 127.0.0.1:5432
+	//
+	// A client rule accepts plaintext connections on the local address and
+	// forwards them through boxconn to the server address. A server rule
+	// accepts boxconn connections and forwards them in plaintext to the
+	// target.
+	rule struct {
+		Server bool
+		Listen string
+		Target string
+		// PeerKey is the server's public key, only used by client rules
+		PeerKey [32]byte
+	}
+)
+
+func (r rule) String() string {
+	if r.Server {
+		return "server " + r.Listen + " -> " + r.Target
+	}
+	return "client " + r.Listen + " -> " + r.Target
+}
+
+// loadConfig reads the rules in a config file
+func loadConfig(path string) ([]rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// parseConfig parses the rules in a config file
+func parseConfig(rd io.Reader) ([]rule, error) {
+	var rules []rule
+	err := boxconn.ParseLines(rd, func(fields []string) error {
+		var r rule
+		switch fields[0] {
+		case "client":
+			if len(fields) != 4 {
+				return fmt.Errorf("expected client <local address> <server address> <server public key>")
+			}
+			key, _, err := boxconn.ParsePublicKey(fields[3])
+			if err != nil {
+				return err
+			}
+			r.PeerKey = key
+		case "server":
+			if len(fields) != 3 {
+				return fmt.Errorf("expected server <listen address> <target address>")
+			}
+			r.Server = true
+		default:
+			return fmt.Errorf("unknown mode %q", fields[0])
+		}
+		r.Listen, r.Target = fields[1], fields[2]
+		rules = append(rules, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no rules")
+	}
+	return rules, nil
+}
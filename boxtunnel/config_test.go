@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	rules, err := parseConfig(strings.NewReader(`# test rules
+client 127.0.0.1:5432 db.example.com:7000 8VBo1sPMIoR8VxB2oKgDs4v7tTFXGSpJ1xdn7DdOGR4=
+
+  server :7000 127.0.0.1:5432 # postgres
+`))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %v", rules)
+	}
+	if rules[0].Server || rules[0].Listen != "127.0.0.1:5432" || rules[0].Target != "db.example.com:7000" || rules[0].PeerKey[0] != 0xf1 {
+		t.Errorf("unexpected client rule: %v", rules[0])
+	}
+	if !rules[1].Server || rules[1].Listen != ":7000" || rules[1].Target != "127.0.0.1:5432" {
+		t.Errorf("unexpected server rule: %v", rules[1])
+	}
+
+	for _, src := range []string{
+		"",
+		"# nothing",
+		"client 127.0.0.1:5432 db.example.com:7000",
+		"client 127.0.0.1:5432 db.example.com:7000 not-a-key",
+		"server :7000",
+		"server :7000 127.0.0.1:5432 extra",
+		"proxy :7000 127.0.0.1:5432",
+	} {
+		if _, err := parseConfig(strings.NewReader(src)); err == nil {
+			t.Errorf("expected an error for %q", src)
+		}
+	}
+}
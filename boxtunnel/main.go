@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+
+	"github.com/badgerodon/net/boxconn"
+)
+
+var (
+	configPath     = flag.String("config", "boxtunnel.conf", "file with the forward rules")
+	keyPath        = flag.String("key", "boxconn.key", "private key file, see boxkey")
+	authorizedKeys = flag.String("authorized-keys", "authorized_keys", "authorized keys file of the clients server rules accept")
+	retryTimeout   = flag.Duration("retry-timeout", defaultRetryTimeout, "how long a connection waits for the other end of the tunnel to come back")
+)
+
+func main() {
+	log.SetFlags(0)
+	flag.Parse()
+
+	rules, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	privateKey, publicKey, err := boxconn.LoadPrivateKeyFile(*keyPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("[boxtunnel] using key", boxconn.Fingerprint(publicKey))
+
+	var keyStore boxconn.KeyStore
+	for _, r := range rules {
+		if r.Server && keyStore == nil {
+			keyStore, err = boxconn.LoadAuthorizedKeys(*authorizedKeys)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range rules {
+		t := newTunnel(r, privateKey, publicKey, keyStore, *retryTimeout)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.run()
+		}()
+	}
+	wg.Wait()
+}
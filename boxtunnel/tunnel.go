@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/badgerodon/net/boxconn"
+)
+
+const (
+	// minRetryDelay and maxRetryDelay bound the wait between attempts to
+	// listen or dial. It doubles after every failure.
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 10 * time.Second
+	// defaultRetryTimeout is how long a connection waits for the other end
+	// of the tunnel when -retry-timeout isn't set
+	defaultRetryTimeout = 30 * time.Second
+	// dialTimeout limits a single attempt to reach the target, including
+	// the handshake of client rules
+	dialTimeout = 10 * time.Second
+)
+
+type (
+	// tunnel runs a single rule
+	tunnel struct {
+		rule   rule
+		config *boxconn.Config
+		// retryTimeout is how long a connection waits for the other end of
+		// the tunnel to come back before it is given up on
+		retryTimeout time.Duration
+
+		mu       sync.Mutex
+		listener net.Listener
+		closed   bool
+	}
+)
+
+// newTunnel creates a tunnel for r. Client rules only allow the server key
+// from the rule, server rules allow the keys in keyStore.
+func newTunnel(r rule, privateKey, publicKey [32]byte, keyStore boxconn.KeyStore, retryTimeout time.Duration) *tunnel {
+	config := &boxconn.Config{
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+		KeyStore:   keyStore,
+	}
+	if !r.Server {
+		config.KeyStore = boxconn.KeyList{r.PeerKey}
+		config.PeerKey = r.PeerKey
+	}
+	return &tunnel{
+		rule:         r,
+		config:       config,
+		retryTimeout: retryTimeout,
+	}
+}
+
+// run listens and forwards connections until the tunnel is closed. If the
+// listener fails it is opened again.
+func (t *tunnel) run() {
+	delay := minRetryDelay
+	for {
+		l, err := t.listen()
+		if t.isClosed() {
+			if err == nil {
+				l.Close()
+			}
+			return
+		}
+		if err != nil {
+			log.Println("[boxtunnel]", t.rule, "failed to listen:", err)
+			time.Sleep(delay)
+			delay = nextRetryDelay(delay)
+			continue
+		}
+		delay = minRetryDelay
+
+		log.Println("[boxtunnel]", t.rule, "listening on", l.Addr())
+		err = t.serve(l)
+		if t.isClosed() {
+			return
+		}
+		log.Println("[boxtunnel]", t.rule, "listener failed:", err)
+	}
+}
+
+// listen opens the listener of the tunnel. Clients accept plaintext
+// connections, servers accept boxconn connections.
+func (t *tunnel) listen() (net.Listener, error) {
+	if t.rule.Server {
+		return boxconn.ListenConfig("tcp", t.rule.Listen, t.config)
+	}
+	return net.Listen("tcp", t.rule.Listen)
+}
+
+// serve forwards connections accepted by l until it fails
+func (t *tunnel) serve(l net.Listener) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return l.Close()
+	}
+	t.listener = l
+	t.mu.Unlock()
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(minRetryDelay)
+				continue
+			}
+			return err
+		}
+		go t.forward(conn)
+	}
+}
+
+// forward connects conn to the other end of the tunnel
+func (t *tunnel) forward(conn net.Conn) {
+	defer conn.Close()
+
+	remote, err := t.dial()
+	if err != nil {
+		log.Println("[boxtunnel]", t.rule, "giving up on", conn.RemoteAddr(), err)
+		return
+	}
+	defer remote.Close()
+
+	pipe(conn, remote)
+}
+
+// dial connects to the target of the rule, retrying until retryTimeout has
+// passed
+func (t *tunnel) dial() (net.Conn, error) {
+	deadline := time.Now().Add(t.retryTimeout)
+	delay := minRetryDelay
+	for {
+		conn, err := t.dialOnce()
+		if err == nil {
+			return conn, nil
+		}
+		// retrying won't help if the server has the wrong key
+		var notAllowed *boxconn.KeyNotAllowedError
+		if errors.As(err, &notAllowed) || t.isClosed() || time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		log.Println("[boxtunnel]", t.rule, "failed to connect, retrying:", err)
+		time.Sleep(delay)
+		delay = nextRetryDelay(delay)
+	}
+}
+
+func (t *tunnel) dialOnce() (net.Conn, error) {
+	if t.rule.Server {
+		return net.DialTimeout("tcp", t.rule.Target, dialTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return boxconn.DialContext(ctx, "tcp", t.rule.Target, t.config)
+}
+
+func (t *tunnel) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.closed
+}
+
+// Close stops accepting connections. Connections already forwarded are left
+// alone.
+func (t *tunnel) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	if t.listener != nil {
+		return t.listener.Close()
+	}
+	return nil
+}
+
+func nextRetryDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// pipe copies data both ways between a and b until both directions are done.
+// When one side stops writing the other side is told so with CloseWrite,
+// which both *net.TCPConn and *boxconn.Conn support. If either direction
+// fails both connections are closed.
+func pipe(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		halfPipe(a, b)
+		close(done)
+	}()
+	halfPipe(b, a)
+	<-done
+}
+
+func halfPipe(dst, src net.Conn) {
+	_, err := io.Copy(dst, src)
+	if err == nil {
+		if cw, ok := dst.(interface {
+			CloseWrite() error
+		}); ok {
+			err = cw.CloseWrite()
+		}
+	}
+	if err != nil {
+		dst.Close()
+		src.Close()
+	}
+}
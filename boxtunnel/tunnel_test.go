@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/badgerodon/net/boxconn"
+)
+
+// echoServer starts a plaintext server which writes back everything it reads
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// startTunnel starts a tunnel on a listener it opened itself, so the address
+// is known right away
+func startTunnel(t *testing.T, tun *tunnel) net.Addr {
+	l, err := tun.listen()
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go tun.serve(l)
+	return l.Addr()
+}
+
+func testKeys(t *testing.T) (clientPriv, clientPub, serverPriv, serverPub [32]byte) {
+	clientPriv, clientPub, err := boxconn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPriv, serverPub, err = boxconn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestTunnel(t *testing.T) {
+	clientPriv, clientPub, serverPriv, serverPub := testKeys(t)
+
+	target := echoServer(t)
+	defer target.Close()
+
+	server := newTunnel(rule{
+		Server: true,
+		Listen: "127.0.0.1:0",
+		Target: target.Addr().String(),
+	}, serverPriv, serverPub, boxconn.KeyList{clientPub}, time.Second)
+	serverAddr := startTunnel(t, server)
+	defer server.Close()
+
+	client := newTunnel(rule{
+		Listen:  "127.0.0.1:0",
+		Target:  serverAddr.String(),
+		PeerKey: serverPub,
+	}, clientPriv, clientPub, nil, time.Second)
+	clientAddr := startTunnel(t, client)
+	defer client.Close()
+
+	conn, err := net.Dial("tcp", clientAddr.String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("Hello World")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	// closing our side is passed along and the echo server closes its side
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	bs, err := ioutil.ReadAll(conn)
+	if err != nil || string(bs) != "Hello World" {
+		t.Errorf("expected %q, got %q %v", "Hello World", bs, err)
+	}
+}
+
+func TestTunnelReconnect(t *testing.T) {
+	clientPriv, clientPub, serverPriv, serverPub := testKeys(t)
+
+	target := echoServer(t)
+	defer target.Close()
+
+	// find a free port for the server, which isn't running yet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serverAddr := l.Addr().String()
+	l.Close()
+
+	client := newTunnel(rule{
+		Listen:  "127.0.0.1:0",
+		Target:  serverAddr,
+		PeerKey: serverPub,
+	}, clientPriv, clientPub, nil, 5*time.Second)
+	clientAddr := startTunnel(t, client)
+	defer client.Close()
+
+	conn, err := net.Dial("tcp", clientAddr.String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	// the client keeps trying until the server shows up
+	time.Sleep(3 * minRetryDelay)
+	server := newTunnel(rule{
+		Server: true,
+		Listen: serverAddr,
+		Target: target.Addr().String(),
+	}, serverPriv, serverPub, boxconn.KeyList{clientPub}, time.Second)
+	go server.run()
+	defer server.Close()
+
+	conn.Write([]byte("Hello World"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	bs := make([]byte, len("Hello World"))
+	if _, err := io.ReadFull(conn, bs); err != nil || string(bs) != "Hello World" {
+		t.Errorf("expected %q, got %q %v", "Hello World", bs, err)
+	}
+}
@@ -3,18 +3,34 @@ package multiplex
 import (
 	"io"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
 type (
+	// Conn is a stream. Received data is buffered until it's read, up to
+	// WindowSize bytes, and writes wait while the peer's buffer is full. A
+	// stream which isn't read only holds up its own writer.
 	Conn struct {
 		multiplexer *Multiplexer
-		buffer      []byte
 		id          UUID
-		in          chan Message
-		closed      bool
-		mu          sync.Mutex
+
+		mu   sync.Mutex
+		cond *sync.Cond
+		// received data which hasn't been read yet
+		pending [][]byte
+		// recvWindow is how much more the peer may send, consumed is how
+		// much has been read since we last told it
+		recvWindow, consumed int
+		// sendWindow is how much more we may send
+		sendWindow   int
+		remoteClosed bool
+		closed       bool
+		// the deadlines of the stream, the timers wake up Read and Write
+		// once they pass
+		readDeadline, writeDeadline time.Time
+		readTimer, writeTimer       *time.Timer
 	}
 )
 
@@ -22,68 +38,134 @@ func NewConn(m *Multiplexer, id UUID) *Conn {
 	c := &Conn{
 		multiplexer: m,
 		id:          id,
-		in:          make(chan Message),
+		recvWindow:  WindowSize,
+		sendWindow:  WindowSize,
 	}
+	c.cond = sync.NewCond(&c.mu)
 	return c
 }
 
-// Read reads data from the connection.
-func (c *Conn) Read(b []byte) (n int, err error) {
+// receive handles a message for the stream from the multiplexer. It never
+// blocks.
+func (c *Conn) receive(msg Message) error {
 	c.mu.Lock()
-	closed := c.closed
-	c.mu.Unlock()
+	defer c.mu.Unlock()
 
-	if closed {
-		return 0, io.EOF
+	switch msg.Code {
+	case DataMessage:
+		if len(msg.Data) > c.recvWindow {
+			return errWindowExceeded
+		}
+		c.recvWindow -= len(msg.Data)
+		if !c.closed && len(msg.Data) > 0 {
+			c.pending = append(c.pending, msg.Data)
+		}
+	case WindowUpdateMessage:
+		c.sendWindow += int(msg.Window)
+	case CloseMessage:
+		c.remoteClosed = true
 	}
+	c.cond.Broadcast()
+	return nil
+}
 
-	sz := len(c.buffer)
-	if sz > 0 {
-		copy(b, c.buffer)
-		if len(b) < sz {
-			c.buffer = c.buffer[len(b):]
-			return len(b), nil
-		} else {
-			c.buffer = nil
-			return sz, nil
+// Read reads data from the connection.
+func (c *Conn) Read(b []byte) (n int, err error) {
+	c.mu.Lock()
+	for len(c.pending) == 0 && !c.closed && !c.remoteClosed {
+		if passed(c.readDeadline) {
+			c.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
 		}
+		c.cond.Wait()
 	}
-	next, ok := <-c.in
-	if !ok {
+	if c.closed {
+		c.mu.Unlock()
 		return 0, io.EOF
 	}
-	if next.Code == CloseMessage {
+	if len(c.pending) == 0 {
+		// the peer closed the stream and we've read everything
+		c.mu.Unlock()
 		c.Close()
 		return 0, io.EOF
 	}
-	sz = len(next.Data)
-	if sz > len(b) {
-		c.buffer = next.Data[len(b):]
-		sz = len(b)
+
+	for n < len(b) && len(c.pending) > 0 {
+		copied := copy(b[n:], c.pending[0])
+		n += copied
+		if copied == len(c.pending[0]) {
+			c.pending[0] = nil
+			c.pending = c.pending[1:]
+		} else {
+			c.pending[0] = c.pending[0][copied:]
+		}
 	}
-	copy(b, next.Data)
-	return sz, nil
+
+	// give the peer its window back once half of it has been read
+	var update int
+	c.consumed += n
+	if c.consumed >= WindowSize/2 && !c.remoteClosed {
+		update = c.consumed
+		c.recvWindow += update
+		c.consumed = 0
+	}
+	c.mu.Unlock()
+
+	if update > 0 {
+		c.multiplexer.Write(Message{StreamID: c.id, Code: WindowUpdateMessage, Window: uint32(update)})
+	}
+	return n, nil
 }
 
-// Write writes data to the connection.
+// Write writes data to the connection. It waits whenever the peer's window
+// is used up, until the peer has read enough.
 func (c *Conn) Write(b []byte) (n int, err error) {
-	c.mu.Lock()
-	closed := c.closed
-	c.mu.Unlock()
-	if closed {
-		return 0, io.EOF
+	for len(b) > 0 {
+		c.mu.Lock()
+		for c.sendWindow == 0 && !c.closed && !c.remoteClosed {
+			if passed(c.writeDeadline) {
+				c.mu.Unlock()
+				return n, os.ErrDeadlineExceeded
+			}
+			c.cond.Wait()
+		}
+		if c.closed || c.remoteClosed {
+			c.mu.Unlock()
+			return n, io.EOF
+		}
+		size := len(b)
+		if size > c.sendWindow {
+			size = c.sendWindow
+		}
+		if size > chunkSize {
+			size = chunkSize
+		}
+		c.sendWindow -= size
+		c.mu.Unlock()
+
+		_, err = c.multiplexer.Write(Message{StreamID: c.id, Code: DataMessage, Data: b[:size]})
+		if err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
 	}
-	return c.multiplexer.Write(Message{c.id, DataMessage, b})
+	return n, nil
 }
 
-// Close closes the connection.
+// Close closes the connection. Blocked Read and Write calls return io.EOF.
 func (c *Conn) Close() error {
 	c.mu.Lock()
-	if !c.closed {
-		c.multiplexer.unregister(c)
-		c.closed = true
+	if c.closed {
+		c.mu.Unlock()
+		return nil
 	}
+	c.closed = true
+	c.pending = nil
+	c.cond.Broadcast()
 	c.mu.Unlock()
+
+	c.multiplexer.unregister(c)
 	return nil
 }
 
@@ -101,15 +183,53 @@ func (c *Conn) RemoteAddr() net.Addr {
 // with the connection. It is equivalent to calling both
 // SetReadDeadline and SetWriteDeadline.
 func (c *Conn) SetDeadline(t time.Time) error {
-	return c.multiplexer.conn.SetDeadline(t)
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
 }
 
-// SetReadDeadline sets the deadline for future Read calls.
+// SetReadDeadline sets the deadline for future Read calls and any
+// currently-blocked Read call. Only this stream is affected.
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	return c.multiplexer.conn.SetReadDeadline(t)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.readTimer = c.wakeAt(c.readTimer, t)
+	return nil
 }
 
-// SetWriteDeadline sets the deadline for future Write calls.
+// SetWriteDeadline sets the deadline for future Write calls and any
+// currently-blocked Write call. A Write only waits for the peer's window,
+// so it may return n > 0. Only this stream is affected.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	return c.multiplexer.conn.SetWriteDeadline(t)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	c.writeTimer = c.wakeAt(c.writeTimer, t)
+	return nil
+}
+
+// wakeAt replaces timer with one which wakes up waiting calls at t, so they
+// notice the deadline passed. Waiting calls are woken right away too, the
+// deadline may have moved. c.mu must be held.
+func (c *Conn) wakeAt(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+		timer = nil
+	}
+	if d := time.Until(t); !t.IsZero() && d > 0 {
+		timer = time.AfterFunc(d, func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+	return timer
+}
+
+// passed returns true if the deadline is set and has passed
+func passed(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
 }
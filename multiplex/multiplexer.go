@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"io"
 	"net"
 	"sync"
@@ -13,11 +14,29 @@ import (
 
 const chunkSize = 8192
 
+// WindowSize is the number of bytes a stream buffers for its reader. A
+// writer may only send that much more than the other side has read, then it
+// waits for a window update. Both sides must use the same size.
+const WindowSize = 256 << 10
+
+// MaxBacklog is the number of streams the peer may open which haven't been
+// accepted yet. Streams beyond it are closed right away.
+const MaxBacklog = 128
+
+var (
+	errWindowExceeded = errors.New("multiplex: stream window exceeded")
+	errInvalidLength  = errors.New("multiplex: invalid message length")
+)
+
 type (
 	UUID        [24]byte
 	Multiplexer struct {
-		conn      net.Conn
-		accept    chan *Conn
+		conn net.Conn
+		// backlog holds new streams until they're accepted, accept is
+		// signalled when one is added
+		backlog   []*Conn
+		accept    chan struct{}
+		done      chan struct{}
 		streams   map[UUID]*Conn
 		closed    bool
 		mu        sync.Mutex
@@ -27,12 +46,19 @@ type (
 		StreamID UUID
 		Code     byte
 		Data     []byte
+		// Window is the number of bytes a WindowUpdateMessage allows the
+		// peer to send on top of what it was allowed before
+		Window uint32
 	}
 )
 
 const DataMessage byte = 1
 const CloseMessage byte = 2
 
+// WindowUpdateMessage tells the peer we've read data from a stream and it
+// may send more
+const WindowUpdateMessage byte = 3
+
 func (msg *Message) Read(r io.Reader) error {
 	_, err := io.ReadFull(r, msg.StreamID[:])
 	if err != nil {
@@ -48,12 +74,22 @@ func (msg *Message) Read(r io.Reader) error {
 		if err != nil {
 			return err
 		}
+		// nothing larger fits in a stream's window, so don't allocate it
+		if sz < 0 || sz > WindowSize {
+			return errInvalidLength
+		}
 		msg.Data = make([]byte, sz)
 		_, err = io.ReadFull(r, msg.Data)
 		if err != nil {
 			return err
 		}
 	}
+	if msg.Code == WindowUpdateMessage {
+		err = binary.Read(r, binary.BigEndian, &msg.Window)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -81,6 +117,13 @@ func (msg *Message) Write(w io.Writer) (int, error) {
 			return n, err
 		}
 	}
+	if msg.Code == WindowUpdateMessage {
+		err = binary.Write(bw, binary.BigEndian, msg.Window)
+		if err != nil {
+			return n, err
+		}
+		n += 4
+	}
 	return n, nil
 }
 
@@ -93,7 +136,8 @@ var generator = fastuuid.MustNewGenerator()
 func New(conn net.Conn) *Multiplexer {
 	m := &Multiplexer{
 		conn:    conn,
-		accept:  make(chan *Conn),
+		accept:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
 		streams: make(map[UUID]*Conn),
 	}
 	go m.dispatch()
@@ -113,27 +157,83 @@ func (m *Multiplexer) dispatch() {
 		}
 
 		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return
+		}
 		conn, ok := m.streams[msg.StreamID]
-		if !ok {
-			conn = NewConn(m, msg.StreamID)
-			m.streams[msg.StreamID] = conn
+		reset := false
+		if !ok && msg.Code == DataMessage {
+			if len(m.backlog) < MaxBacklog {
+				// new streams wait in the backlog, so a stream which isn't
+				// accepted doesn't hold up the others
+				conn = NewConn(m, msg.StreamID)
+				m.streams[msg.StreamID] = conn
+				m.backlog = append(m.backlog, conn)
+				m.signalAccept()
+			} else {
+				reset = true
+			}
 		}
 		m.mu.Unlock()
 
-		if !ok {
-			m.accept <- conn
+		if reset {
+			// the peer may not be reading either, so don't wait for the
+			// write here
+			go m.Write(Message{StreamID: msg.StreamID, Code: CloseMessage})
+			continue
+		}
+
+		// window updates and closes can cross our own close
+		if conn == nil {
+			continue
+		}
+		// this never blocks, a stream which isn't read doesn't hold up the
+		// others
+		err = conn.receive(msg)
+		if err != nil {
+			break
 		}
-		conn.in <- msg
 	}
 }
 
-// Accept waits for and returns the next connection to the listener.
+// Accept waits for and returns the next connection to the listener. Streams
+// the peer opened before the multiplexer was closed can still be accepted,
+// with whatever they've buffered.
 func (m *Multiplexer) Accept() (c net.Conn, err error) {
-	conn, ok := <-m.accept
-	if !ok {
-		return nil, io.EOF
+	for {
+		m.mu.Lock()
+		if len(m.backlog) > 0 {
+			conn := m.backlog[0]
+			m.backlog[0] = nil
+			m.backlog = m.backlog[1:]
+			// let the next Accept know if there are more
+			if len(m.backlog) > 0 {
+				m.signalAccept()
+			}
+			m.mu.Unlock()
+			return conn, nil
+		}
+		closed := m.closed
+		m.mu.Unlock()
+		if closed {
+			return nil, io.EOF
+		}
+
+		select {
+		case <-m.accept:
+		case <-m.done:
+			return nil, io.EOF
+		}
+	}
+}
+
+// signalAccept wakes up a waiting Accept. m.mu must be held.
+func (m *Multiplexer) signalAccept() {
+	select {
+	case m.accept <- struct{}{}:
+	default:
 	}
-	return conn, nil
 }
 
 // Close closes the listener.
@@ -149,11 +249,12 @@ func (m *Multiplexer) Close() error {
 	m.closed = true
 	m.mu.Unlock()
 
-	m.closed = true
+	// streams end as if the peer closed them, so what they've buffered can
+	// still be read
 	for _, stream := range streams {
-		stream.Close()
+		stream.receive(Message{StreamID: stream.id, Code: CloseMessage})
 	}
-	close(m.accept)
+	close(m.done)
 	return m.conn.Close()
 }
 
@@ -187,7 +288,6 @@ func (m *Multiplexer) Write(msg Message) (int, error) {
 func (m *Multiplexer) unregister(conn *Conn) {
 	m.mu.Lock()
 	delete(m.streams, conn.id)
-	close(conn.in)
 	m.mu.Unlock()
-	m.Write(Message{conn.id, CloseMessage, nil})
+	m.Write(Message{StreamID: conn.id, Code: CloseMessage})
 }
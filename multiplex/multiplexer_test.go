@@ -1,9 +1,14 @@
 package multiplex
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
 	"io/ioutil"
 	"net"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -66,3 +71,257 @@ func TestMultiplexer(t *testing.T) {
 		<-done
 	}
 }
+
+// multiplexerPair connects two multiplexers over TCP
+func multiplexerPair(t *testing.T) (*Multiplexer, *Multiplexer) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	c2 := <-accepted
+	if c2 == nil {
+		t.Fatalf("failed to accept")
+	}
+	return New(c1), New(c2)
+}
+
+func TestMessageWindowUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	msg := Message{StreamID: generator.Next(), Code: WindowUpdateMessage, Window: 12345}
+	_, err := msg.Write(&buf)
+	assert.Nil(err)
+
+	var read Message
+	assert.Nil(read.Read(&buf))
+	assert.Equal(msg, read)
+	assert.Equal(0, buf.Len())
+}
+
+func TestMessageLength(t *testing.T) {
+	assert := assert.New(t)
+
+	id := generator.Next()
+	for _, sz := range []int64{-1, WindowSize + 1, 1 << 40} {
+		var buf bytes.Buffer
+		buf.Write(id[:])
+		buf.WriteByte(DataMessage)
+		binary.Write(&buf, binary.BigEndian, sz)
+
+		var msg Message
+		assert.Equal(errInvalidLength, msg.Read(&buf), "size %d", sz)
+	}
+}
+
+func TestUnacceptedStream(t *testing.T) {
+	assert := assert.New(t)
+
+	client, server := multiplexerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	first, err := client.Open()
+	assert.Nil(err)
+	first.Write([]byte("1"))
+	firstServer, err := server.Accept()
+	assert.Nil(err)
+
+	// nobody accepts the second stream yet
+	second, err := client.Open()
+	assert.Nil(err)
+	second.Write([]byte("2"))
+
+	// the first stream carries on
+	first.Write([]byte("3"))
+	read := make(chan string, 1)
+	go func() {
+		bs := make([]byte, 2)
+		io.ReadFull(firstServer, bs)
+		read <- string(bs)
+	}()
+	select {
+	case msg := <-read:
+		assert.Equal("13", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected an unaccepted stream not to hold up the others")
+	}
+
+	secondServer, err := server.Accept()
+	assert.Nil(err)
+	bs := make([]byte, 1)
+	_, err = io.ReadFull(secondServer, bs)
+	assert.Nil(err)
+	assert.Equal("2", string(bs))
+}
+
+func TestFlowControl(t *testing.T) {
+	assert := assert.New(t)
+
+	client, server := multiplexerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// a stream nobody reads fills its window and its writer waits
+	slow, err := client.Open()
+	assert.Nil(err)
+	data := bytes.Repeat([]byte("x"), 2*WindowSize)
+	written := make(chan error, 1)
+	go func() {
+		_, err := slow.Write(data)
+		written <- err
+	}()
+	slowServer, err := server.Accept()
+	assert.Nil(err)
+
+	// other streams carry on
+	fast, err := client.Open()
+	assert.Nil(err)
+	fast.Write([]byte("Hello World"))
+	fastServer, err := server.Accept()
+	assert.Nil(err)
+	bs := make([]byte, 11)
+	_, err = io.ReadFull(fastServer, bs)
+	assert.Nil(err)
+	assert.Equal("Hello World", string(bs))
+
+	select {
+	case <-written:
+		t.Fatalf("expected the write to wait for the reader")
+	case <-time.After(50 * time.Millisecond):
+	}
+	sc := slowServer.(*Conn)
+	sc.mu.Lock()
+	buffered := WindowSize - sc.recvWindow
+	sc.mu.Unlock()
+	assert.True(buffered <= WindowSize, "expected at most a window to be buffered, got %d", buffered)
+
+	// reading lets the writer finish
+	bs = make([]byte, len(data))
+	_, err = io.ReadFull(slowServer, bs)
+	assert.Nil(err)
+	assert.Equal(data, bs)
+	assert.Nil(<-written)
+}
+
+func TestFlowControlClose(t *testing.T) {
+	client, server := multiplexerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	c, _ := client.Open()
+	c.Write(bytes.Repeat([]byte("x"), WindowSize))
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("more"))
+		written <- err
+	}()
+
+	// closing the stream unblocks its writer
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Errorf("expected the write to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Close to unblock Write")
+	}
+}
+
+func TestBacklogLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	client, server := multiplexerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// nobody accepts any of them
+	for i := 0; i < MaxBacklog; i++ {
+		c, err := client.Open()
+		assert.Nil(err)
+		c.Write([]byte("x"))
+	}
+
+	// the peer closes streams beyond the backlog
+	extra, err := client.Open()
+	assert.Nil(err)
+	extra.Write([]byte("x"))
+	read := make(chan error, 1)
+	go func() {
+		_, err := extra.Read(make([]byte, 1))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		assert.Equal(io.EOF, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a stream beyond the backlog to be closed")
+	}
+
+	server.mu.Lock()
+	backlog := len(server.backlog)
+	server.mu.Unlock()
+	assert.Equal(MaxBacklog, backlog)
+}
+
+func TestDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	client, server := multiplexerPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	c, err := client.Open()
+	assert.Nil(err)
+	c.Write(bytes.Repeat([]byte("x"), WindowSize))
+	sc, err := server.Accept()
+	assert.Nil(err)
+
+	// a Read with nothing to read and a Write without window time out
+	c.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = c.Read(make([]byte, 1))
+	assert.Equal(os.ErrDeadlineExceeded, err)
+	_, err = c.Write([]byte("more"))
+	assert.Equal(os.ErrDeadlineExceeded, err)
+
+	// only this stream is affected
+	other, err := server.Open()
+	assert.Nil(err)
+	_, err = other.Write([]byte("still fine"))
+	assert.Nil(err)
+
+	// moving the deadline wakes up a waiting Read
+	c.SetDeadline(time.Time{})
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.SetReadDeadline(time.Now())
+	select {
+	case err := <-read:
+		assert.Equal(os.ErrDeadlineExceeded, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected SetReadDeadline to wake up Read")
+	}
+
+	// without a deadline the stream works as before
+	c.SetDeadline(time.Time{})
+	io.ReadFull(sc, make([]byte, WindowSize))
+	_, err = c.Write([]byte("more"))
+	assert.Nil(err)
+}